@@ -0,0 +1,100 @@
+/*
+Copyright 2020 Google LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/google/slowjam/pkg/stackparse"
+)
+
+// fsck checks stack logs for corrupt records and truncated samples, printing each problem found. It returns the exit
+// status: 0 if every log is intact, 1 if problems were found, and 2 if a log could not be read.
+func fsck(paths []string) int {
+	if len(paths) == 0 {
+		fmt.Fprintln(os.Stderr, "usage: slowjam fsck <path> [<path>...]")
+		return 64 // EX_USAGE
+	}
+
+	status := 0
+
+	for _, path := range inputs(paths) {
+		samples, fetches, diags, err := check(path)
+		for _, d := range diags {
+			fmt.Println(d)
+		}
+
+		switch {
+		case err != nil:
+			fmt.Fprintf(os.Stderr, "%s: %v\n", path, err)
+
+			status = 2
+		case len(diags) > 0:
+			fmt.Printf("%s: %d samples, %d problems\n", path, samples, len(diags))
+
+			if status == 0 {
+				status = 1
+			}
+		default:
+			fmt.Printf("%s: %d samples, ok\n", path, samples)
+		}
+
+		if len(fetches) > 0 {
+			fmt.Printf("%s: %d fetches (%d failed) not followed by a sample\n", path, len(fetches), failedFetches(fetches))
+		}
+	}
+
+	return status
+}
+
+// check reads a stack log tolerantly, returning the number of samples recovered, the attempts to fetch stacks which
+// were not followed by a sample, and the problems found.
+func check(path string) (int, []*stackparse.Fetch, []*stackparse.Diagnostic, error) {
+	r, err := open(path)
+	if err != nil {
+		return 0, nil, nil, err
+	}
+	defer r.Close()
+
+	r.SetTolerant(true)
+
+	samples := 0
+
+	for _, err := range r.All() {
+		if err != nil {
+			return samples, nil, r.Diagnostics(), err
+		}
+
+		samples++
+	}
+
+	return samples, r.Fetches(), r.Diagnostics(), nil
+}
+
+// failedFetches returns how many attempts to fetch stacks failed.
+func failedFetches(fs []*stackparse.Fetch) int {
+	n := 0
+
+	for _, f := range fs {
+		if f.Err != "" {
+			n++
+		}
+	}
+
+	return n
+}
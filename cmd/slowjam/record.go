@@ -0,0 +1,112 @@
+/*
+Copyright 2020 Google LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"github.com/spf13/pflag"
+
+	"github.com/google/slowjam/pkg/stacklog"
+)
+
+// maxDump is the largest goroutine dump accepted from a remote process.
+const maxDump = 256 << 20
+
+// record samples the goroutines of a remote process by polling its net/http/pprof goroutine endpoint, writing a
+// stack log. It returns the exit status.
+func record(args []string) int {
+	fs := pflag.NewFlagSet("record", pflag.ContinueOnError)
+	url := fs.String("url", "", "goroutine dump endpoint to poll, such as http://localhost:6060/debug/pprof/goroutine?debug=2")
+	interval := fs.Duration("interval", 250*time.Millisecond, "how often to fetch a goroutine dump")
+	duration := fs.Duration("duration", 0, "how long to record for (default: until interrupted)")
+	timeout := fs.Duration("timeout", 5*time.Second, "how long to wait for each goroutine dump before skipping the sample")
+	output := fs.StringP("output", "o", "", "path to write the stack log to (default: a temporary file)")
+
+	if err := fs.Parse(args); err != nil {
+		return 64 // EX_USAGE
+	}
+
+	if *url == "" || fs.NArg() > 0 {
+		fmt.Fprintln(os.Stderr, "usage: slowjam record --url <url> [--interval 250ms] [--duration 2m] [-o out.slog]")
+		return 64 // EX_USAGE
+	}
+
+	ctx, cancel := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer cancel()
+
+	if *duration > 0 {
+		ctx, cancel = context.WithTimeout(ctx, *duration)
+		defer cancel()
+	}
+
+	s, err := stacklog.Start(stacklog.Config{
+		Path:       *output,
+		Poll:       *interval,
+		Source:     fetcher(&http.Client{Timeout: *timeout}, *url),
+		SourceName: *url,
+	})
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "record: %v\n", err)
+		return 1
+	}
+
+	<-ctx.Done()
+
+	if err := s.Stop(); err != nil {
+		fmt.Fprintf(os.Stderr, "record: %v\n", err)
+		return 1
+	}
+
+	return 0
+}
+
+// fetcher returns a stacklog source which fetches goroutine dumps from a URL, in the format of
+// /debug/pprof/goroutine?debug=2.
+func fetcher(client *http.Client, url string) func() ([]byte, error) {
+	return func() ([]byte, error) {
+		resp, err := client.Get(url)
+		if err != nil {
+			return nil, err
+		}
+		defer resp.Body.Close()
+
+		if resp.StatusCode != http.StatusOK {
+			return nil, fmt.Errorf("%s: %s", url, resp.Status)
+		}
+
+		bs, err := io.ReadAll(io.LimitReader(resp.Body, maxDump))
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", url, err)
+		}
+
+		// debug=1 aggregates goroutines by stack, and lacks their IDs and states
+		if !bytes.HasPrefix(bs, []byte("goroutine ")) || bytes.HasPrefix(bs, []byte("goroutine profile:")) {
+			return nil, fmt.Errorf("%s: not a goroutine dump; the URL should end in goroutine?debug=2", url)
+		}
+
+		return bs, nil
+	}
+}
@@ -0,0 +1,213 @@
+/*
+Copyright 2020 Google LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/google/slowjam/pkg/stacklog"
+	"github.com/google/slowjam/pkg/stackparse"
+)
+
+// dump is a goroutine dump in the format of /debug/pprof/goroutine?debug=2.
+const dump = `goroutine 1 [running]:
+main.main()
+	/app/main.go:10 +0x1d
+
+goroutine 7 [chan receive]:
+main.worker()
+	/app/main.go:20 +0x2a
+created by main.main in goroutine 1
+	/app/main.go:12 +0x3f
+`
+
+func TestFetcher(t *testing.T) {
+	tests := []struct {
+		name    string
+		handler http.HandlerFunc
+		timeout time.Duration
+		wantErr string
+	}{
+		{
+			name:    "dump",
+			handler: func(w http.ResponseWriter, _ *http.Request) { _, _ = w.Write([]byte(dump)) },
+		},
+		{
+			name:    "not found",
+			handler: func(w http.ResponseWriter, _ *http.Request) { http.NotFound(w, nil) },
+			wantErr: "404 Not Found",
+		},
+		{
+			name: "debug=1",
+			handler: func(w http.ResponseWriter, _ *http.Request) {
+				_, _ = w.Write([]byte("goroutine profile: total 2\n1 @ 0x1 0x2\n"))
+			},
+			wantErr: "not a goroutine dump",
+		},
+		{
+			name: "timeout",
+			handler: func(w http.ResponseWriter, r *http.Request) {
+				<-r.Context().Done()
+			},
+			timeout: 50 * time.Millisecond,
+			wantErr: "Timeout",
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			srv := httptest.NewServer(tc.handler)
+			defer srv.Close()
+
+			bs, err := fetcher(&http.Client{Timeout: tc.timeout}, srv.URL)()
+
+			if tc.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tc.wantErr) {
+					t.Fatalf("fetcher error = %v, want it to contain %q", err, tc.wantErr)
+				}
+
+				return
+			}
+
+			if err != nil {
+				t.Fatalf("fetcher: %v", err)
+			}
+
+			if string(bs) != dump {
+				t.Errorf("fetcher = %q, want %q", bs, dump)
+			}
+		})
+	}
+}
+
+// TestRecordFetches checks that the latency of every fetch is recorded, including those that fail, and that none
+// of it is reported as a sampler pause.
+func TestRecordFetches(t *testing.T) {
+	var n atomic.Int64
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		if n.Add(1)%2 == 0 {
+			http.Error(w, "busy", http.StatusServiceUnavailable)
+			return
+		}
+
+		_, _ = w.Write([]byte(dump))
+	}))
+	defer srv.Close()
+
+	var b bytes.Buffer
+
+	s, err := stacklog.Start(stacklog.Config{
+		Writer:     &b,
+		Poll:       10 * time.Millisecond,
+		Quiet:      true,
+		Source:     fetcher(&http.Client{Timeout: time.Second}, srv.URL),
+		SourceName: srv.URL,
+	})
+	if err != nil {
+		t.Fatalf("start: %v", err)
+	}
+
+	time.Sleep(200 * time.Millisecond)
+
+	if err := s.Stop(); err != nil {
+		t.Fatalf("stop: %v", err)
+	}
+
+	l, err := stackparse.ReadLog(&b)
+	if err != nil {
+		t.Fatalf("read: %v", err)
+	}
+
+	if len(l.Samples) == 0 {
+		t.Fatal("no samples recorded")
+	}
+
+	fetches, failed := 0, 0
+
+	for _, s := range l.Samples {
+		if s.Pause != 0 {
+			t.Errorf("sample at %s has pause %s, want 0", s.Time, s.Pause)
+		}
+
+		for _, f := range s.Fetches {
+			fetches++
+
+			if f.Latency <= 0 {
+				t.Errorf("fetch at %s has latency %s, want > 0", f.Time, f.Latency)
+			}
+
+			if f.Err != "" {
+				failed++
+			}
+		}
+	}
+
+	if fetches < len(l.Samples) {
+		t.Errorf("got %d fetches for %d samples, want at least one per sample", fetches, len(l.Samples))
+	}
+
+	if failed == 0 {
+		t.Errorf("got no failed fetches, want those answered with 503")
+	}
+}
+
+// TestRecordFailedFetches checks that a recording in which every fetch failed keeps the attempts.
+func TestRecordFailedFetches(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		http.Error(w, "busy", http.StatusServiceUnavailable)
+	}))
+	defer srv.Close()
+
+	var b bytes.Buffer
+
+	s, err := stacklog.Start(stacklog.Config{
+		Writer:     &b,
+		Poll:       10 * time.Millisecond,
+		Quiet:      true,
+		Source:     fetcher(&http.Client{Timeout: time.Second}, srv.URL),
+		SourceName: srv.URL,
+	})
+	if err != nil {
+		t.Fatalf("start: %v", err)
+	}
+
+	time.Sleep(100 * time.Millisecond)
+
+	if err := s.Stop(); err != nil {
+		t.Fatalf("stop: %v", err)
+	}
+
+	l, err := stackparse.ReadLog(&b)
+	if err != nil {
+		t.Fatalf("read: %v", err)
+	}
+
+	if len(l.Samples) != 0 {
+		t.Fatalf("got %d samples, want none", len(l.Samples))
+	}
+
+	if len(l.Fetches) == 0 || failedFetches(l.Fetches) != len(l.Fetches) {
+		t.Errorf("got %d fetches, %d failed, want every attempt kept as failed", len(l.Fetches), failedFetches(l.Fetches))
+	}
+}
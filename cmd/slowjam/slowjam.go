@@ -17,8 +17,10 @@ limitations under the License.
 package main
 
 import (
+	"errors"
 	"fmt"
 	"os"
+	"path/filepath"
 
 	"github.com/spf13/pflag"
 	"k8s.io/klog/v2"
@@ -36,37 +38,79 @@ var (
 	pprofPath    = pflag.String("pprof", "", "Path to output pprof content to (consider using --goroutines=1)")
 	goroutines   = pflag.IntSlice("goroutines", []int{}, "goroutines to include (default: all)")
 	dumpText     = pflag.Bool("text", false, "Outputs text rendering of goroutines found")
+	labels       = pflag.StringToString("labels", map[string]string{}, "only include goroutines with these pprof label values, such as tenant=a")
+	groupBy      = pflag.String("group-by", "", "pprof label to group goroutines by")
+	tolerant     = pflag.Bool("tolerant", false, "skip corrupt records and recover truncated samples, warning about each")
+	dumps        = pflag.Bool("dumps", false, "read timestamped goroutine?debug=2 dumps rather than stack logs (implied for directories)")
+	profiles     = pflag.Bool("profiles", false, "read goroutine profiles rather than stack logs (implied for .pb.gz files, and directories of them)")
 )
 
 func main() {
 	klog.InitFlags(nil)
+
+	// record has flags of its own
+	if len(os.Args) > 1 && os.Args[1] == "record" {
+		os.Exit(record(os.Args[2:]))
+	}
+
 	pflag.Parse()
 
 	s := stacklog.MustStartFromEnv("STACKLOG_PATH")
 	defer s.Stop()
 
-	if len(pflag.Args()) != 1 {
-		fmt.Fprintln(os.Stderr, "usage: slowjam [flags] <path>")
+	if len(pflag.Args()) < 1 {
+		fmt.Fprintln(os.Stderr, "usage: slowjam [flags] <path> [<path>...]")
+		fmt.Fprintln(os.Stderr, "       slowjam fsck <path> [<path>...]")
+		fmt.Fprintln(os.Stderr, "       slowjam record --url <url> [flags]")
 		os.Exit(64) // EX_USAGE
 	}
 
-	f, err := os.Open(pflag.Args()[0])
-	if err != nil {
-		klog.Fatalf("open: %v", err)
+	if pflag.Arg(0) == "fsck" {
+		status := fsck(pflag.Args()[1:])
+		s.Stop()
+		os.Exit(status)
 	}
 
-	defer func() {
-		if err := f.Close(); err != nil {
-			klog.Errorf("close failed: %v", err)
+	o := stackparse.TimelineOptions{
+		IgnoreCreators: stackparse.SuggestedIgnore,
+		Goroutines:     *goroutines,
+		Labels:         *labels,
+		GroupBy:        *groupBy,
+	}
+
+	paths := inputs(pflag.Args())
+	procs := []*stackparse.Process{}
+
+	// Samples are only kept in memory if a pprof profile is to be rendered from them
+	var l *stackparse.Log
+
+	for _, path := range paths {
+		p, pl, err := readTimeline(path, o, *pprofPath != "")
+		if err != nil {
+			klog.Fatalf("parse: %v", err)
 		}
-	}()
 
-	samples, err := stackparse.Read(f)
-	if err != nil {
-		klog.Fatalf("parse: %v", err)
+		if p.Timeline.Samples == 0 && len(p.Timeline.Fetches) == 0 {
+			klog.Warningf("%s: no samples found", path)
+			continue
+		}
+
+		if p.Timeline.Samples == 0 {
+			klog.Warningf("%s: no samples found, only %d fetches (%d failed)", path, len(p.Timeline.Fetches), p.Timeline.FailedFetches())
+		}
+
+		procs = append(procs, p)
+		l = pl
+	}
+
+	if len(procs) == 0 {
+		klog.Exitf("no samples found")
 	}
 
-	tl := stackparse.CreateTimeline(samples, stackparse.SuggestedIgnore, *goroutines)
+	tl := procs[0].Timeline
+	if len(paths) > 1 {
+		tl = stackparse.MergeTimelines(procs)
+	}
 
 	if *httpEndpoint != "" {
 		web.Serve(*httpEndpoint, tl)
@@ -88,13 +132,17 @@ func main() {
 	}
 
 	if *pprofPath != "" {
+		if len(paths) > 1 {
+			klog.Exitf("--pprof supports a single input")
+		}
+
 		w, err := os.Create(*pprofPath)
 		if err != nil {
 			klog.Exitf("open failed: %v", err)
 		}
 		defer w.Close()
 
-		bs, err := pprof.Render(samples, stackparse.SuggestedIgnore, *goroutines)
+		bs, err := pprof.RenderWithMetadata(l.Samples, l.Metadata, stackparse.SuggestedIgnore, *goroutines)
 		if err != nil {
 			klog.Fatalf("render: %v", err)
 		}
@@ -113,3 +161,104 @@ func main() {
 
 	klog.Exitf("no output mode specified")
 }
+
+// readTimeline creates the timeline of a stack log one sample at a time, optionally keeping the samples.
+func readTimeline(path string, o stackparse.TimelineOptions, keep bool) (*stackparse.Process, *stackparse.Log, error) {
+	if isProfiles(path) {
+		return readProfiles(path, o)
+	}
+
+	r, err := open(path)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer r.Close()
+
+	r.SetTolerant(*tolerant)
+	b := stackparse.NewTimelineBuilder(o)
+	l := &stackparse.Log{}
+
+	for s, err := range r.All() {
+		var d *stackparse.Diagnostic
+		if errors.As(err, &d) {
+			return nil, nil, fmt.Errorf("%w (pass --tolerant to read it anyway)", err)
+		}
+
+		if err != nil {
+			return nil, nil, err
+		}
+
+		b.Add(s)
+
+		if keep {
+			l.Samples = append(l.Samples, s)
+		}
+	}
+
+	for _, d := range r.Diagnostics() {
+		klog.Warningf("skipped: %v", d)
+	}
+
+	b.SetMetadata(r.Metadata())
+	b.AddFetches(r.Fetches())
+	tl := b.Timeline()
+	l.Metadata = r.Metadata()
+	l.Fetches = r.Fetches()
+
+	return &stackparse.Process{Name: stackparse.ProcessName(path, tl.Metadata), Timeline: tl}, l, nil
+}
+
+// readProfiles creates the timeline of a sequence of goroutine profiles, which are small enough to be read at once.
+func readProfiles(path string, o stackparse.TimelineOptions) (*stackparse.Process, *stackparse.Log, error) {
+	l, err := pprof.ReadProfiles(path)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	o.Metadata = l.Metadata
+	tl := stackparse.CreateTimelineWithOptions(l.Samples, o)
+
+	return &stackparse.Process{Name: stackparse.ProcessName(path, nil), Timeline: tl}, l, nil
+}
+
+// isProfiles returns true if path is a goroutine profile, or a directory of them, or --profiles is set.
+func isProfiles(path string) bool {
+	if *profiles || pprof.IsProfile(path) {
+		return true
+	}
+
+	fs, err := pprof.ProfileFiles(path)
+
+	return err == nil && len(fs) > 0
+}
+
+// open returns a reader for a stack log, or for goroutine dumps if path is a directory or --dumps is set.
+func open(path string) (*stackparse.Reader, error) {
+	if fi, err := os.Stat(path); *dumps || (err == nil && fi.IsDir()) {
+		return stackparse.OpenDumps(path)
+	}
+
+	return stackparse.OpenFile(path)
+}
+
+// inputs returns the stack logs to read, leaving out rotated segments of other inputs, such as out.1.slog.gz when
+// out.slog.gz is also given, as they are read along with the first segment.
+func inputs(args []string) []string {
+	segments := map[string]bool{}
+
+	for _, a := range args {
+		for _, p := range stackparse.Segments(a)[1:] {
+			segments[filepath.Clean(p)] = true
+		}
+	}
+
+	paths := []string{}
+
+	for _, a := range args {
+		if !segments[filepath.Clean(a)] {
+			paths = append(paths, a)
+		}
+	}
+
+	return paths
+}
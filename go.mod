@@ -6,6 +6,7 @@ toolchain go1.24.1
 
 require (
 	github.com/golang/protobuf v1.5.4
+	github.com/klauspost/compress v1.18.0
 	github.com/maruel/panicparse/v2 v2.5.0
 	github.com/spf13/pflag v1.0.7
 	google.golang.org/protobuf v1.36.6
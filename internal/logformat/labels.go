@@ -0,0 +1,83 @@
+/*
+Copyright 2020 Google LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package logformat
+
+import (
+	"strconv"
+	"strings"
+)
+
+// HeaderLabels parses the runtime/pprof labels from a goroutine header line, such as:
+//
+//	goroutine 7 [select] {request: 42, tenant: "a b"}:
+//
+// It returns nil if the header has no labels, or they could not be parsed.
+func HeaderLabels(header string) map[string]string {
+	i := strings.Index(header, "] {")
+	if i < 0 || !strings.HasSuffix(header, "}:") {
+		return nil
+	}
+
+	body := header[i+len("] {") : len(header)-len("}:")]
+	labels := map[string]string{}
+
+	for body != "" {
+		k, rest, ok := labelToken(body, ':')
+		if !ok {
+			return nil
+		}
+
+		v, rest, ok := labelToken(strings.TrimPrefix(rest, " "), ',')
+		if !ok {
+			return nil
+		}
+
+		labels[k] = v
+		body = strings.TrimPrefix(rest, " ")
+	}
+
+	return labels
+}
+
+// labelToken reads a possibly quoted key or value, followed by sep or the end of input.
+func labelToken(s string, sep byte) (string, string, bool) {
+	if strings.HasPrefix(s, `"`) {
+		q, err := strconv.QuotedPrefix(s)
+		if err != nil {
+			return "", "", false
+		}
+
+		v, err := strconv.Unquote(q)
+		if err != nil {
+			return "", "", false
+		}
+
+		rest := s[len(q):]
+		if rest != "" && rest[0] != sep {
+			return "", "", false
+		}
+
+		return v, strings.TrimPrefix(rest, string(sep)), true
+	}
+
+	i := strings.IndexByte(s, sep)
+	if i < 0 {
+		return s, "", true
+	}
+
+	return s[:i], s[i+1:], true
+}
@@ -0,0 +1,50 @@
+/*
+Copyright 2020 Google LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package logformat holds the parts of the stack log format shared by the stacklog writer and the stackparse reader.
+package logformat
+
+import (
+	"fmt"
+	"path/filepath"
+	"strings"
+)
+
+// V2Magic is the first line of a v2 stack log, which only records goroutines that changed between samples.
+const V2Magic = "slowjam v2"
+
+// SegmentPath returns the path of the nth segment of a rotated stack log, numbering it before the file extension:
+// out.slog.gz, out.1.slog.gz, out.2.slog.gz. The first segment is the path itself.
+func SegmentPath(path string, n int) string {
+	if n == 0 {
+		return path
+	}
+
+	dir, base := filepath.Split(path)
+	ext := ""
+
+	for _, c := range []string{".gz", ".zst"} {
+		if strings.HasSuffix(base, c) {
+			ext = c
+			base = strings.TrimSuffix(base, c)
+		}
+	}
+
+	ext = filepath.Ext(base) + ext
+	base = strings.TrimSuffix(base, filepath.Ext(base))
+
+	return filepath.Join(dir, fmt.Sprintf("%s.%d%s", base, n, ext))
+}
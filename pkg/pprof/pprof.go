@@ -40,6 +40,12 @@ func ix(m map[string]int64, key string) int64 {
 
 // Render outputs a pprof protobuf somewhere.
 func Render(samples []*stackparse.StackSample, ignoreCreators []string, goroutines []int) ([]byte, error) {
+	return RenderWithMetadata(samples, nil, ignoreCreators, goroutines)
+}
+
+// RenderWithMetadata outputs a pprof protobuf, recording metadata about the recorded process, if available, as
+// profile comments.
+func RenderWithMetadata(samples []*stackparse.StackSample, md *stackparse.Metadata, ignoreCreators []string, goroutines []int) ([]byte, error) {
 	st := map[string]int64{"": 0}
 
 	p := &Profile{
@@ -55,6 +61,16 @@ func Render(samples []*stackparse.StackSample, ignoreCreators []string, goroutin
 	p.Location = loc
 	p.Function = fx
 
+	for _, line := range md.Describe() {
+		p.Comment = append(p.Comment, ix(st, line))
+	}
+
+	if md != nil {
+		for _, m := range md.Modules {
+			p.Comment = append(p.Comment, ix(st, fmt.Sprintf("module: %s %s", m.Path, m.Version)))
+		}
+	}
+
 	p.StringTable = make([]string, len(st)+1)
 	for k, v := range st {
 		p.StringTable[v] = k
@@ -0,0 +1,325 @@
+/*
+Copyright 2020 Google LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package pprof
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/google/slowjam/pkg/stackparse"
+	"google.golang.org/protobuf/proto"
+)
+
+// profileExts are the file extensions of goroutine profiles.
+var profileExts = []string{".pb.gz", ".pb", ".pprof"}
+
+// parkedStates map the function which parked a goroutine to the state the runtime reports for it, by prefix.
+var parkedStates = []struct {
+	prefix string
+	state  string
+}{
+	{"runtime.selectgo", "select"},
+	{"runtime.block", "select (no cases)"},
+	{"runtime.chanrecv", "chan receive"},
+	{"runtime.chansend", "chan send"},
+	{"runtime.netpollblock", "IO wait"},
+	{"internal/poll.runtime_pollWait", "IO wait"},
+	{"runtime.semacquire", "semacquire"},
+	{"sync.runtime_Semacquire", "semacquire"},
+	{"internal/sync.runtime_Semacquire", "semacquire"},
+	{"sync.runtime_notifyListWait", "sync.Cond.Wait"},
+	{"runtime.notifyListWait", "sync.Cond.Wait"},
+	{"time.Sleep", "sleep"},
+	{"runtime.timeSleep", "sleep"},
+}
+
+// IsProfile returns true if a file is named like a goroutine profile, such as goroutine.pb.gz.
+func IsProfile(path string) bool {
+	for _, ext := range profileExts {
+		if strings.HasSuffix(path, ext) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// ProfileFiles returns the goroutine profiles within a directory.
+func ProfileFiles(dir string) ([]string, error) {
+	des, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	paths := []string{}
+
+	for _, de := range des {
+		if de.Type().IsRegular() && !strings.HasPrefix(de.Name(), ".") && IsProfile(de.Name()) {
+			paths = append(paths, filepath.Join(dir, de.Name()))
+		}
+	}
+
+	return paths, nil
+}
+
+// ReadProfiles converts a sequence of goroutine profiles, such as those fetched from /debug/pprof/goroutine, into
+// samples ordered by the time each profile was taken. The path may be a profile, or a directory of them.
+//
+// A goroutine profile counts goroutines by stack and labels rather than listing them, so each is given a synthetic ID
+// which is stable across profiles for as long as that many goroutines share its stack, and the state the runtime
+// would report for it is inferred from the function which parked it.
+func ReadProfiles(path string) (*stackparse.Log, error) {
+	l := &stackparse.Log{Samples: []*stackparse.StackSample{}}
+	paths := []string{path}
+
+	fi, err := os.Stat(path)
+	if err != nil {
+		return l, err
+	}
+
+	if fi.IsDir() {
+		paths, err = ProfileFiles(path)
+		if err != nil {
+			return l, err
+		}
+
+		if len(paths) == 0 {
+			return l, fmt.Errorf("%s: no goroutine profiles found", path)
+		}
+	}
+
+	ps := []*Profile{}
+
+	for _, p := range paths {
+		prof, err := readProfile(p)
+		if err != nil {
+			return l, fmt.Errorf("%s: %w", p, err)
+		}
+
+		ps = append(ps, prof)
+	}
+
+	sort.SliceStable(ps, func(i, j int) bool { return ps[i].GetTimeNanos() < ps[j].GetTimeNanos() })
+
+	ids := &goroutineIDs{byKey: map[string][]int{}}
+
+	for i, p := range ps {
+		s, err := stackparse.NewSample(time.Unix(0, p.GetTimeNanos()), ids.stacks(p))
+		if err != nil {
+			return l, fmt.Errorf("profile %d: %w", i, err)
+		}
+
+		l.Samples = append(l.Samples, s)
+	}
+
+	return l, nil
+}
+
+// readProfile reads a goroutine profile, which may be gzip compressed.
+func readProfile(path string) (*Profile, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var r io.Reader = bufio.NewReader(f)
+
+	if head, _ := r.(*bufio.Reader).Peek(2); bytes.Equal(head, []byte{0x1f, 0x8b}) {
+		zr, err := gzip.NewReader(r)
+		if err != nil {
+			return nil, err
+		}
+		defer zr.Close()
+
+		r = zr
+	}
+
+	bs, err := io.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+
+	p := &Profile{}
+	if err := proto.Unmarshal(bs, p); err != nil {
+		return nil, fmt.Errorf("unmarshal: %w", err)
+	}
+
+	st := p.GetStringTable()
+	if len(p.GetSampleType()) == 0 || str(st, p.GetSampleType()[0].GetType()) != "goroutine" {
+		return nil, fmt.Errorf("not a goroutine profile")
+	}
+
+	if p.GetTimeNanos() == 0 {
+		return nil, fmt.Errorf("profile has no time")
+	}
+
+	return p, nil
+}
+
+// str returns an entry of a profile string table, tolerating indexes which are out of range.
+func str(st []string, i int64) string {
+	if i < 0 || i >= int64(len(st)) {
+		return ""
+	}
+
+	return st[i]
+}
+
+// frame is a single function call within a goroutine profile stack.
+type frame struct {
+	fn   string
+	file string
+	line int64
+}
+
+// goroutineIDs assigns synthetic goroutine IDs to the goroutines counted by a sequence of profiles.
+type goroutineIDs struct {
+	// byKey are the IDs given to goroutines with the same stack and labels
+	byKey map[string][]int
+	last  int
+}
+
+// stacks converts a goroutine profile into runtime.Stack output, with a goroutine per count of each sample.
+func (g *goroutineIDs) stacks(p *Profile) []byte {
+	st := p.GetStringTable()
+
+	fns := map[uint64]*Function{}
+	for _, f := range p.GetFunction() {
+		fns[f.GetId()] = f
+	}
+
+	locs := map[uint64]*Location{}
+	for _, l := range p.GetLocation() {
+		locs[l.GetId()] = l
+	}
+
+	used := map[string]int{}
+
+	var b bytes.Buffer
+
+	for _, s := range p.GetSample() {
+		frames := []frame{}
+
+		for _, lid := range s.GetLocationId() {
+			for _, ln := range locs[lid].GetLine() {
+				f := fns[ln.GetFunctionId()]
+				if f == nil {
+					continue
+				}
+
+				frames = append(frames, frame{fn: str(st, f.GetName()), file: str(st, f.GetFilename()), line: ln.GetLine()})
+			}
+		}
+
+		if len(frames) == 0 || len(s.GetValue()) == 0 {
+			continue
+		}
+
+		var body strings.Builder
+		for _, f := range frames {
+			body.WriteString(fmt.Sprintf("%s(...)\n\t%s:%d\n", f.fn, f.file, f.line))
+		}
+
+		labels := sampleLabels(st, s.GetLabel())
+		key := labels + "\n" + body.String()
+		header := fmt.Sprintf("[%s]", inferState(frames))
+
+		if labels != "" {
+			header = fmt.Sprintf("%s {%s}", header, labels)
+		}
+
+		for i := int64(0); i < s.GetValue()[0]; i++ {
+			b.WriteString(fmt.Sprintf("goroutine %d %s:\n%s\n", g.id(key, used[key]), header, body.String()))
+			used[key]++
+		}
+	}
+
+	return b.Bytes()
+}
+
+// id returns the ID of the nth goroutine with a stack and labels, assigning one if it has not been seen before.
+func (g *goroutineIDs) id(key string, n int) int {
+	if n >= len(g.byKey[key]) {
+		g.last++
+		g.byKey[key] = append(g.byKey[key], g.last)
+	}
+
+	return g.byKey[key][n]
+}
+
+// sampleLabels formats the labels of a sample as runtime.Stack does, such as: request: 42, tenant: "a b"
+func sampleLabels(st []string, ls []*Label) string {
+	kvs := []string{}
+
+	for _, l := range ls {
+		v := str(st, l.GetStr())
+		if l.GetStr() == 0 {
+			v = strconv.FormatInt(l.GetNum(), 10)
+		}
+
+		kvs = append(kvs, fmt.Sprintf("%s: %s", quoteLabel(str(st, l.GetKey())), quoteLabel(v)))
+	}
+
+	sort.Strings(kvs)
+
+	return strings.Join(kvs, ", ")
+}
+
+// quoteLabel quotes a label key or value if it would otherwise be ambiguous.
+func quoteLabel(s string) string {
+	if s == "" || strings.ContainsAny(s, " :,{}\"\\") || strconv.Quote(s) != `"`+s+`"` {
+		return strconv.Quote(s)
+	}
+
+	return s
+}
+
+// inferState returns the state the runtime would report for a goroutine, based on the function which parked it.
+func inferState(frames []frame) string {
+	i := 0
+	for i < len(frames) && (frames[i].fn == "runtime.gopark" || frames[i].fn == "runtime.goparkunlock") {
+		i++
+	}
+
+	if i == 0 {
+		if strings.HasPrefix(frames[0].fn, "syscall.") || frames[0].fn == "runtime.cgocall" {
+			return "syscall"
+		}
+
+		return "running"
+	}
+
+	if i < len(frames) {
+		for _, p := range parkedStates {
+			if strings.HasPrefix(frames[i].fn, p.prefix) {
+				return p.state
+			}
+		}
+	}
+
+	return "waiting"
+}
@@ -0,0 +1,74 @@
+/*
+Copyright 2020 Google LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package stacklog
+
+import (
+	"compress/gzip"
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+// Compression selects how stack samples are compressed on their way to disk.
+type Compression int
+
+const (
+	// CompressionAuto compresses based on the path suffix: gzip for .gz, zstd for .zst, otherwise none.
+	CompressionAuto Compression = iota
+	// CompressionNone writes plain text.
+	CompressionNone
+	// CompressionGzip writes a gzip stream.
+	CompressionGzip
+	// CompressionZstd writes a zstd stream.
+	CompressionZstd
+)
+
+// compressor is a compressing writer that can be flushed between samples.
+type compressor interface {
+	io.WriteCloser
+	Flush() error
+}
+
+// compressionFor resolves CompressionAuto using the suffix of a path.
+func compressionFor(c Compression, path string) Compression {
+	if c != CompressionAuto {
+		return c
+	}
+
+	switch {
+	case strings.HasSuffix(path, ".gz"):
+		return CompressionGzip
+	case strings.HasSuffix(path, ".zst"):
+		return CompressionZstd
+	default:
+		return CompressionNone
+	}
+}
+
+// newCompressor wraps w with the requested compression.
+func newCompressor(w io.Writer, c Compression) (compressor, error) {
+	switch c {
+	case CompressionGzip:
+		return gzip.NewWriter(w), nil
+	case CompressionZstd:
+		return zstd.NewWriter(w, zstd.WithEncoderConcurrency(1))
+	default:
+		return nil, fmt.Errorf("unknown compression: %d", c)
+	}
+}
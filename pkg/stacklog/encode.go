@@ -0,0 +1,310 @@
+/*
+Copyright 2020 Google LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package stacklog
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/google/slowjam/internal/logformat"
+)
+
+// Format selects the layout of a stack log.
+type Format int
+
+const (
+	// FormatDefault uses the most recent format, currently FormatV2.
+	FormatDefault Format = iota
+	// FormatV1 writes the full output of runtime.Stack for every sample.
+	FormatV1
+	// FormatV2 writes only the goroutines that changed since the previous sample, with interned frames.
+	FormatV2
+)
+
+// maxFrames bounds the v2 frame table, which grows as argument values change.
+const maxFrames = 1 << 16
+
+// encoder serializes samples into a stack log stream.
+type encoder interface {
+	encode(w io.Writer, sm sample) (int64, error)
+	// encodeOverhead records the time taken to record the previous sample, if the format has room for it.
+	encodeOverhead(w io.Writer, total time.Duration, pause time.Duration) error
+	// encodeFetch records a failed attempt to fetch stacks, if the format has room for it.
+	encodeFetch(w io.Writer, f fetch) error
+}
+
+// newEncoder returns a fresh encoder for the given format. The v1 format has no room for a header.
+func newEncoder(f Format, h *header) encoder {
+	if f == FormatV1 {
+		return v1Encoder{}
+	}
+
+	return &v2Encoder{header: h}
+}
+
+// v1Encoder writes a timestamp, the raw stacks, and a "-" terminator for every sample.
+type v1Encoder struct{}
+
+func (v1Encoder) encode(w io.Writer, sm sample) (int64, error) {
+	var b bytes.Buffer
+
+	fmt.Fprintf(&b, "%d\n", sm.t.UnixNano())
+	b.Write(sm.stacks)
+	b.WriteString("-\n")
+
+	// A single write keeps a record from being split by a failure
+	n, err := w.Write(b.Bytes())
+
+	return int64(n), err
+}
+
+func (v1Encoder) encodeOverhead(io.Writer, time.Duration, time.Duration) error {
+	return nil
+}
+
+func (v1Encoder) encodeFetch(io.Writer, fetch) error {
+	return nil
+}
+
+// v2Encoder writes samples as deltas against the previous sample.
+//
+// A v2 stream is line oriented. The magic line is followed by an "H <json>" header describing the process, then
+// each sample is preceded by an "M <json>" line for every marker recorded since the previous sample, and an
+// "L <json>" line for every attempt to fetch stacks from Config.Source since then, including any that failed. A
+// sample is a "T <unix nanos> <monotonic nanos since start>" line followed by:
+//
+//	V <json>                             runtime/metrics values, by name
+//	F <id> <quoted text>                 defines an interned frame: a call line and its source location
+//	G <goroutine> <ids> <quoted header>  a goroutine whose header or frames changed
+//	X <goroutine>                        a goroutine that has exited since the previous sample
+//	R                                    forget all frames and goroutines seen so far
+//	-                                    the end of the sample
+//
+// A sample may be followed by an "O <total nanos> <pause nanos>" line, recording the time taken to record it, and
+// how long the world was stopped to capture its stacks.
+type v2Encoder struct {
+	header  *header
+	started bool
+	frames  map[string]int
+	last    map[int]string
+}
+
+// start writes the magic line and header, if they have not been written yet.
+func (e *v2Encoder) start(b *bytes.Buffer) error {
+	if e.started {
+		return nil
+	}
+
+	fmt.Fprintf(b, "%s\n", logformat.V2Magic)
+
+	if e.header != nil {
+		js, err := json.Marshal(e.header)
+		if err != nil {
+			return fmt.Errorf("header: %w", err)
+		}
+
+		fmt.Fprintf(b, "H %s\n", js)
+	}
+
+	e.started = true
+
+	return nil
+}
+
+func (e *v2Encoder) encode(w io.Writer, sm sample) (int64, error) {
+	var b bytes.Buffer
+
+	if err := e.start(&b); err != nil {
+		return 0, err
+	}
+
+	for _, ev := range sm.events {
+		js, err := json.Marshal(ev)
+		if err != nil {
+			return 0, fmt.Errorf("marker: %w", err)
+		}
+
+		fmt.Fprintf(&b, "M %s\n", js)
+	}
+
+	for _, f := range sm.fetches {
+		js, err := json.Marshal(f)
+		if err != nil {
+			return 0, fmt.Errorf("fetch: %w", err)
+		}
+
+		fmt.Fprintf(&b, "L %s\n", js)
+	}
+
+	if e.header != nil {
+		fmt.Fprintf(&b, "T %d %d\n", sm.t.UnixNano(), sm.t.Sub(e.header.Start).Nanoseconds())
+	} else {
+		fmt.Fprintf(&b, "T %d\n", sm.t.UnixNano())
+	}
+
+	if len(sm.metrics) > 0 {
+		js, err := json.Marshal(sm.metrics)
+		if err != nil {
+			return 0, fmt.Errorf("metrics: %w", err)
+		}
+
+		fmt.Fprintf(&b, "V %s\n", js)
+	}
+
+	if e.frames == nil || len(e.frames) > maxFrames {
+		if e.frames != nil {
+			b.WriteString("R\n")
+		}
+
+		e.frames = map[string]int{}
+		e.last = map[int]string{}
+	}
+
+	seen := map[int]bool{}
+
+	for _, g := range splitGoroutines(sm.stacks) {
+		ids := make([]string, 0, len(g.frames))
+
+		for _, f := range g.frames {
+			id, ok := e.frames[f]
+			if !ok {
+				id = len(e.frames) + 1
+				e.frames[f] = id
+				fmt.Fprintf(&b, "F %d %s\n", id, strconv.Quote(f))
+			}
+
+			ids = append(ids, strconv.Itoa(id))
+		}
+
+		fids := "-"
+		if len(ids) > 0 {
+			fids = strings.Join(ids, ",")
+		}
+
+		rec := fmt.Sprintf("G %d %s %s\n", g.id, fids, strconv.Quote(g.header))
+		seen[g.id] = true
+
+		if e.last[g.id] == rec {
+			continue
+		}
+
+		e.last[g.id] = rec
+		b.WriteString(rec)
+	}
+
+	gone := []int{}
+
+	for id := range e.last {
+		if !seen[id] {
+			gone = append(gone, id)
+		}
+	}
+
+	sort.Ints(gone)
+
+	for _, id := range gone {
+		delete(e.last, id)
+		fmt.Fprintf(&b, "X %d\n", id)
+	}
+
+	b.WriteString("-\n")
+
+	n, err := w.Write(b.Bytes())
+
+	return int64(n), err
+}
+
+func (e *v2Encoder) encodeOverhead(w io.Writer, total time.Duration, pause time.Duration) error {
+	if total == 0 {
+		return nil
+	}
+
+	_, err := fmt.Fprintf(w, "O %d %d\n", total.Nanoseconds(), pause.Nanoseconds())
+
+	return err
+}
+
+func (e *v2Encoder) encodeFetch(w io.Writer, f fetch) error {
+	var b bytes.Buffer
+
+	if err := e.start(&b); err != nil {
+		return err
+	}
+
+	js, err := json.Marshal(f)
+	if err != nil {
+		return fmt.Errorf("fetch: %w", err)
+	}
+
+	fmt.Fprintf(&b, "L %s\n", js)
+
+	_, err = w.Write(b.Bytes())
+
+	return err
+}
+
+// goroutineText is the text of a single goroutine within runtime.Stack output.
+type goroutineText struct {
+	id     int
+	header string
+	frames []string
+}
+
+// splitGoroutines splits runtime.Stack output into goroutines, grouping call and location lines into frames.
+func splitGoroutines(stacks []byte) []goroutineText {
+	gs := []goroutineText{}
+
+	for _, block := range strings.Split(string(stacks), "\n\n") {
+		lines := strings.Split(strings.TrimRight(block, "\n"), "\n")
+		if len(lines) == 0 || !strings.HasPrefix(lines[0], "goroutine ") {
+			continue
+		}
+
+		fields := strings.Fields(lines[0])
+		if len(fields) < 2 {
+			continue
+		}
+
+		id, err := strconv.Atoi(fields[1])
+		if err != nil {
+			continue
+		}
+
+		g := goroutineText{id: id, header: lines[0]}
+
+		for i := 1; i < len(lines); i++ {
+			if !strings.HasPrefix(lines[i], "\t") && i+1 < len(lines) && strings.HasPrefix(lines[i+1], "\t") {
+				g.frames = append(g.frames, lines[i]+"\n"+lines[i+1])
+				i++
+
+				continue
+			}
+
+			g.frames = append(g.frames, lines[i])
+		}
+
+		gs = append(gs, g)
+	}
+
+	return gs
+}
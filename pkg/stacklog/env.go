@@ -0,0 +1,212 @@
+/*
+Copyright 2020 Google LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package stacklog
+
+import (
+	"fmt"
+	"math"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Environment variables which tune loggers started by MustStartFromEnv.
+const (
+	pollEnv     = "STACKLOG_POLL"
+	quietEnv    = "STACKLOG_QUIET"
+	maxSizeEnv  = "STACKLOG_MAX_SIZE"
+	childrenEnv = "STACKLOG_CHILDREN"
+	metricsEnv  = "STACKLOG_METRICS"
+	raiseEnv    = "STACKLOG_RAISE"
+)
+
+// configFromEnv builds the configuration for MustStartFromEnv.
+func configFromEnv(path string) (Config, error) {
+	c := Config{Path: path, Quiet: defaultQuiet, Poll: defaultPoll}
+
+	if v := os.Getenv(pollEnv); v != "" {
+		d, err := time.ParseDuration(v)
+		if err != nil || d <= 0 {
+			return c, fmt.Errorf("%s: invalid duration %q", pollEnv, v)
+		}
+
+		c.Poll = d
+	}
+
+	if v := os.Getenv(quietEnv); v != "" {
+		q, err := strconv.ParseBool(v)
+		if err != nil {
+			return c, fmt.Errorf("%s: %w", quietEnv, err)
+		}
+
+		c.Quiet = q
+	}
+
+	if v := os.Getenv(maxSizeEnv); v != "" {
+		n, err := parseSize(v)
+		if err != nil {
+			return c, fmt.Errorf("%s: %w", maxSizeEnv, err)
+		}
+
+		c.MaxSize = n
+	}
+
+	if v := os.Getenv(metricsEnv); v != "" {
+		m, err := parseMetrics(v)
+		if err != nil {
+			return c, fmt.Errorf("%s: %w", metricsEnv, err)
+		}
+
+		c.Metrics = m
+	}
+
+	return c, nil
+}
+
+// raiseFromEnv returns whether shutdown signals should be raised again once the logger has stopped, which they are
+// unless STACKLOG_RAISE is false.
+func raiseFromEnv() (bool, error) {
+	v := os.Getenv(raiseEnv)
+	if v == "" {
+		return true, nil
+	}
+
+	on, err := strconv.ParseBool(v)
+	if err != nil {
+		return false, fmt.Errorf("%s: %w", raiseEnv, err)
+	}
+
+	return on, nil
+}
+
+// parseMetrics parses either a boolean, which selects DefaultMetrics, or a comma-separated list of runtime/metrics
+// names, such as "/gc/heap/live:bytes,/sched/goroutines:goroutines".
+func parseMetrics(v string) ([]string, error) {
+	if !strings.HasPrefix(v, "/") {
+		on, err := strconv.ParseBool(v)
+		if err != nil {
+			return nil, err
+		}
+
+		if on {
+			return DefaultMetrics, nil
+		}
+
+		return nil, nil
+	}
+
+	names := []string{}
+
+	for _, n := range strings.Split(v, ",") {
+		if n = strings.TrimSpace(n); n != "" {
+			names = append(names, n)
+		}
+	}
+
+	return names, nil
+}
+
+// sizeSuffixes are the binary multiples accepted by parseSize.
+var sizeSuffixes = []struct {
+	suffix string
+	mult   int64
+}{
+	{"K", 1 << 10},
+	{"M", 1 << 20},
+	{"G", 1 << 30},
+}
+
+// parseSize parses a number of bytes, optionally suffixed by K, M or G for binary multiples, and by B, such as "512M"
+// or "512B".
+func parseSize(v string) (int64, error) {
+	s := strings.TrimSuffix(strings.ToUpper(v), "B")
+	mult := int64(1)
+
+	for _, u := range sizeSuffixes {
+		if t, ok := strings.CutSuffix(s, u.suffix); ok {
+			s = t
+			mult = u.mult
+
+			break
+		}
+	}
+
+	n, err := strconv.ParseInt(s, 10, 64)
+	if err != nil || n < 0 {
+		return 0, fmt.Errorf("invalid size %q", v)
+	}
+
+	if n > math.MaxInt64/mult {
+		return 0, fmt.Errorf("size %q is too large", v)
+	}
+
+	return n * mult, nil
+}
+
+// propagateToChildren points child processes, which inherit the environment, at sibling files of path rather than
+// path itself. A path which already contains the %p placeholder gives each process its own file as it is.
+func propagateToChildren(key string, path string) error {
+	v := os.Getenv(childrenEnv)
+	if v == "" {
+		return nil
+	}
+
+	on, err := strconv.ParseBool(v)
+	if err != nil {
+		return fmt.Errorf("%s: %w", childrenEnv, err)
+	}
+
+	if !on || strings.Contains(path, "%p") {
+		return nil
+	}
+
+	return os.Setenv(key, childPath(path))
+}
+
+// childPath returns the path template for child processes: out.slog.gz becomes out-%p.slog.gz.
+func childPath(path string) string {
+	dir, base := filepath.Split(path)
+
+	name, ext, found := strings.Cut(base, ".")
+	if !found {
+		return path + "-%p"
+	}
+
+	return filepath.Join(dir, name+"-%p."+ext)
+}
+
+// expandPath replaces the placeholders in a path: %p with the process ID, %t with the start time, %h with the
+// hostname, and %% with a literal %.
+func expandPath(path string, start time.Time) string {
+	if !strings.Contains(path, "%") {
+		return path
+	}
+
+	host, err := os.Hostname()
+	if err != nil {
+		host = "localhost"
+	}
+
+	return strings.NewReplacer(
+		"%%", "%",
+		"%p", strconv.Itoa(os.Getpid()),
+		"%t", start.Format("20060102T150405"),
+		"%h", host,
+	).Replace(path)
+}
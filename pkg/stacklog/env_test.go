@@ -0,0 +1,68 @@
+/*
+Copyright 2020 Google LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package stacklog
+
+import (
+	"math"
+	"testing"
+)
+
+func TestParseSize(t *testing.T) {
+	tests := []struct {
+		in      string
+		want    int64
+		wantErr bool
+	}{
+		{in: "0", want: 0},
+		{in: "512", want: 512},
+		{in: "512B", want: 512},
+		{in: "512b", want: 512},
+		{in: "4K", want: 4 << 10},
+		{in: "4KB", want: 4 << 10},
+		{in: "512M", want: 512 << 20},
+		{in: "512mb", want: 512 << 20},
+		{in: "2G", want: 2 << 30},
+		{in: "2GB", want: 2 << 30},
+		{in: "9223372036854775807", want: math.MaxInt64},
+		{in: "8589934591G", want: 8589934591 << 30},
+		{in: "8589934592G", wantErr: true},
+		{in: "9999999999G", wantErr: true},
+		{in: "9223372036854775808", wantErr: true},
+		{in: "", wantErr: true},
+		{in: "B", wantErr: true},
+		{in: "-1M", wantErr: true},
+		{in: "1.5G", wantErr: true},
+		{in: "12T", wantErr: true},
+		{in: "1BB", wantErr: true},
+	}
+
+	for _, tc := range tests {
+		got, err := parseSize(tc.in)
+
+		if tc.wantErr {
+			if err == nil {
+				t.Errorf("parseSize(%q) = %d, want an error", tc.in, got)
+			}
+
+			continue
+		}
+
+		if err != nil || got != tc.want {
+			t.Errorf("parseSize(%q) = %d, %v, want %d", tc.in, got, err, tc.want)
+		}
+	}
+}
@@ -0,0 +1,266 @@
+/*
+Copyright 2020 Google LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package stacklog
+
+import (
+	"bytes"
+	"context"
+	"regexp"
+	"runtime"
+	"runtime/pprof"
+	"strings"
+
+	"github.com/google/slowjam/internal/logformat"
+)
+
+// Rule matches goroutines, for including or excluding them from a stack log. Every field that is set must match.
+// Function and package patterns may use * as a wildcard, and match either the full name, such as
+// "net/http.(*Server).Serve", or the short name used by slowjam, such as "http.(*Server).Serve".
+type Rule struct {
+	// Creator matches the function which started the goroutine.
+	Creator string
+	// Package matches the package of the innermost frame outside of the Go runtime, such as "net/http".
+	Package string
+	// Label matches a runtime/pprof label as "key=value", where the value may use * as a wildcard. Labels are only
+	// included in stacks with GODEBUG=tracebacklabels=1 on Go 1.27 or later, so Start rejects label rules without it.
+	Label string
+}
+
+// ruleMatcher is a compiled Rule.
+type ruleMatcher struct {
+	creator  *regexp.Regexp
+	pkg      *regexp.Regexp
+	labelKey string
+	label    *regexp.Regexp
+}
+
+// filter decides which goroutines are recorded.
+type filter struct {
+	include []ruleMatcher
+	exclude []ruleMatcher
+}
+
+// newFilter compiles include and exclude rules, returning nil if there are none.
+func newFilter(include []Rule, exclude []Rule) *filter {
+	if len(include) == 0 && len(exclude) == 0 {
+		return nil
+	}
+
+	f := &filter{}
+
+	for _, r := range include {
+		f.include = append(f.include, compileRule(r))
+	}
+
+	for _, r := range exclude {
+		f.exclude = append(f.exclude, compileRule(r))
+	}
+
+	return f
+}
+
+// compileRule turns the patterns of a rule into regular expressions.
+func compileRule(r Rule) ruleMatcher {
+	m := ruleMatcher{}
+
+	if r.Creator != "" {
+		m.creator = glob(r.Creator)
+	}
+
+	if r.Package != "" {
+		m.pkg = glob(r.Package)
+	}
+
+	if r.Label != "" {
+		k, v, _ := strings.Cut(r.Label, "=")
+		m.labelKey = k
+		m.label = glob(v)
+	}
+
+	return m
+}
+
+// hasLabelRule returns whether any rule matches labels.
+func hasLabelRule(include []Rule, exclude []Rule) bool {
+	for _, r := range append(append([]Rule{}, include...), exclude...) {
+		if r.Label != "" {
+			return true
+		}
+	}
+
+	return false
+}
+
+// tracebackLabels returns whether runtime.Stack includes the runtime/pprof labels of each goroutine.
+func tracebackLabels() bool {
+	found := false
+
+	pprof.Do(context.Background(), pprof.Labels("stacklog", "probe"), func(context.Context) {
+		buf := make([]byte, 1024)
+		n := runtime.Stack(buf, false)
+		header, _, _ := strings.Cut(string(buf[:n]), "\n")
+		found = logformat.HeaderLabels(header)["stacklog"] == "probe"
+	})
+
+	return found
+}
+
+// glob compiles a pattern in which * matches any run of characters.
+func glob(pattern string) *regexp.Regexp {
+	parts := strings.Split(pattern, "*")
+	for i, p := range parts {
+		parts[i] = regexp.QuoteMeta(p)
+	}
+
+	return regexp.MustCompile("^" + strings.Join(parts, ".*") + "$")
+}
+
+// apply removes the goroutines which are not to be recorded from runtime.Stack output.
+func (f *filter) apply(stacks []byte) []byte {
+	if f == nil {
+		return stacks
+	}
+
+	blocks := bytes.Split(bytes.TrimRight(stacks, "\n"), []byte("\n\n"))
+	kept := make([][]byte, 0, len(blocks))
+
+	for _, b := range blocks {
+		if f.keep(string(b)) {
+			kept = append(kept, b)
+		}
+	}
+
+	if len(kept) == 0 {
+		return nil
+	}
+
+	return append(bytes.Join(kept, []byte("\n\n")), '\n')
+}
+
+// keep returns whether a goroutine should be recorded.
+func (f *filter) keep(block string) bool {
+	g := describeGoroutine(block)
+
+	if len(f.include) > 0 {
+		found := false
+
+		for _, m := range f.include {
+			if m.matches(g) {
+				found = true
+				break
+			}
+		}
+
+		if !found {
+			return false
+		}
+	}
+
+	for _, m := range f.exclude {
+		if m.matches(g) {
+			return false
+		}
+	}
+
+	return true
+}
+
+// goroutineFacts are the properties of a goroutine that rules match against.
+type goroutineFacts struct {
+	creator string
+	pkg     string
+	labels  map[string]string
+}
+
+// matches returns whether a goroutine matches every field set in the rule.
+func (m ruleMatcher) matches(g goroutineFacts) bool {
+	if m.creator != nil && !matchName(m.creator, g.creator) {
+		return false
+	}
+
+	if m.pkg != nil && !matchName(m.pkg, g.pkg) {
+		return false
+	}
+
+	if m.label != nil {
+		v, ok := g.labels[m.labelKey]
+		if !ok || !m.label.MatchString(v) {
+			return false
+		}
+	}
+
+	return true
+}
+
+// matchName matches a pattern against the full or short form of a function or package name.
+func matchName(re *regexp.Regexp, name string) bool {
+	if name == "" {
+		return false
+	}
+
+	return re.MatchString(name) || re.MatchString(name[strings.LastIndex(name, "/")+1:])
+}
+
+// describeGoroutine extracts the creator, package and labels of a goroutine from its runtime.Stack output.
+func describeGoroutine(block string) goroutineFacts {
+	lines := strings.Split(block, "\n")
+	g := goroutineFacts{labels: logformat.HeaderLabels(lines[0])}
+
+	for _, line := range lines[1:] {
+		if strings.HasPrefix(line, "\t") {
+			continue
+		}
+
+		if fn, ok := strings.CutPrefix(line, "created by "); ok {
+			fn, _, _ = strings.Cut(fn, " in goroutine ")
+			g.creator = fn
+
+			continue
+		}
+
+		if g.pkg == "" {
+			g.pkg = userPackage(funcName(line))
+		}
+	}
+
+	return g
+}
+
+// funcName returns the function name of a call line, such as "main.(*T).run(0x1, ...)".
+func funcName(line string) string {
+	if i := strings.LastIndex(line, "("); i > 0 {
+		return line[:i]
+	}
+
+	return line
+}
+
+// userPackage returns the package of a function, or nothing if it is part of the Go runtime.
+func userPackage(fn string) string {
+	slash := strings.LastIndex(fn, "/")
+
+	pkg := fn
+	if dot := strings.Index(fn[slash+1:], "."); dot >= 0 {
+		pkg = fn[:slash+1+dot]
+	}
+
+	if pkg == "runtime" || strings.HasPrefix(pkg, "runtime/") || strings.HasPrefix(pkg, "internal/") {
+		return ""
+	}
+
+	return pkg
+}
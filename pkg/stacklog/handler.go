@@ -0,0 +1,226 @@
+/*
+Copyright 2020 Google LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package stacklog
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/google/slowjam/internal/logformat"
+)
+
+// handler controls a stack logger over HTTP.
+type handler struct {
+	config Config
+
+	mu sync.Mutex
+	s  *Stacklog
+}
+
+// status describes the most recent stack logger started by a handler.
+type status struct {
+	Running  bool       `json:"running"`
+	Path     string     `json:"path,omitempty"`
+	Poll     string     `json:"poll,omitempty"`
+	Started  *time.Time `json:"started,omitempty"`
+	Samples  int        `json:"samples"`
+	Bytes    int64      `json:"bytes"`
+	Segments int        `json:"segments"`
+	Limit    string     `json:"limit,omitempty"`
+}
+
+// Handler returns an http.Handler which controls a stack logger configured by c, much like net/http/pprof. Mount it
+// on a debug mux with:
+//
+//	mux.Handle("/debug/slowjam/", stacklog.Handler(stacklog.Config{}))
+//
+// It serves:
+//
+//	start     starts sampling. The poll and duration query parameters override c.Poll and c.MaxDuration.
+//	stop      stops sampling.
+//	status    describes the current or most recent stack logger as JSON.
+//	download  streams the stack log of the current or most recent stack logger.
+//
+// If c.Path is empty, each start logs to a new temporary file.
+func Handler(c Config) http.Handler {
+	return &handler{config: c}
+}
+
+func (h *handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	switch path.Base(r.URL.Path) {
+	case "start":
+		h.start(w, r)
+	case "stop":
+		h.stop(w)
+	case "status":
+		h.status(w)
+	case "download":
+		h.download(w, r)
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+// start starts a stack logger, unless one is already running.
+func (h *handler) start(w http.ResponseWriter, r *http.Request) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if h.s.running() {
+		http.Error(w, "stacklog: already running", http.StatusConflict)
+		return
+	}
+
+	c := h.config
+
+	for _, p := range []struct {
+		name string
+		d    *time.Duration
+	}{{"poll", &c.Poll}, {"duration", &c.MaxDuration}} {
+		v := r.URL.Query().Get(p.name)
+		if v == "" {
+			continue
+		}
+
+		d, err := time.ParseDuration(v)
+		if err != nil || d <= 0 {
+			http.Error(w, fmt.Sprintf("stacklog: invalid %s: %q", p.name, v), http.StatusBadRequest)
+			return
+		}
+
+		*p.d = d
+	}
+
+	s, err := Start(c)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("stacklog: start: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	h.s = s
+	writeStatus(w, s)
+}
+
+// stop stops the running stack logger.
+func (h *handler) stop(w http.ResponseWriter) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if h.s == nil {
+		http.Error(w, "stacklog: not started", http.StatusConflict)
+		return
+	}
+
+	if err := h.s.Stop(); err != nil {
+		http.Error(w, fmt.Sprintf("stacklog: stop: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	writeStatus(w, h.s)
+}
+
+// status describes the current or most recent stack logger.
+func (h *handler) status(w http.ResponseWriter) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	writeStatus(w, h.s)
+}
+
+// download streams the stack log, one segment after another. While sampling, it includes the samples written so far.
+func (h *handler) download(w http.ResponseWriter, r *http.Request) {
+	h.mu.Lock()
+	s := h.s
+	h.mu.Unlock()
+
+	switch {
+	case s == nil:
+		http.Error(w, "stacklog: not started", http.StatusNotFound)
+		return
+	case s.ring != nil:
+		s.ServeHTTP(w, r)
+		return
+	case s.writer != nil:
+		http.Error(w, "stacklog: samples are sent to a writer rather than a file", http.StatusNotFound)
+		return
+	}
+
+	s.mu.Lock()
+	segments := s.segment + 1
+	s.mu.Unlock()
+
+	w.Header().Set("Content-Type", "application/octet-stream")
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", filepath.Base(s.path)))
+
+	for n := 0; n < segments; n++ {
+		if err := copyFile(w, logformat.SegmentPath(s.path, n)); err != nil {
+			if !s.quiet {
+				fmt.Fprintf(os.Stderr, "stacklog: http download failed: %v\n", err)
+			}
+
+			return
+		}
+	}
+}
+
+// copyFile writes the contents of a file to w.
+func copyFile(w io.Writer, path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	_, err = io.Copy(w, f)
+
+	return err
+}
+
+// writeStatus responds with the status of a stack logger, which may be nil.
+func writeStatus(w http.ResponseWriter, s *Stacklog) {
+	st := status{}
+
+	if s != nil && s.header != nil {
+		s.mu.Lock()
+		st.Samples = s.samples
+		st.Segments = s.segment + 1
+		s.mu.Unlock()
+
+		st.Running = s.running()
+		st.Path = s.path
+		st.Poll = s.header.Poll.String()
+		st.Started = &s.header.Start
+		st.Bytes = s.written.Load()
+
+		if !st.Running {
+			st.Limit = s.limit
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+
+	if err := json.NewEncoder(w).Encode(st); err != nil && s != nil && !s.quiet {
+		fmt.Fprintf(os.Stderr, "stacklog: http status failed: %v\n", err)
+	}
+}
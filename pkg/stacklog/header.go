@@ -0,0 +1,87 @@
+/*
+Copyright 2020 Google LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package stacklog
+
+import (
+	"os"
+	"runtime"
+	"runtime/debug"
+	"time"
+)
+
+// header describes the process being sampled, and is written at the start of a v2 stack log.
+type header struct {
+	Start      time.Time     `json:"start"`
+	Poll       time.Duration `json:"poll"`
+	MinPoll    time.Duration `json:"min_poll,omitempty"`
+	MaxPoll    time.Duration `json:"max_poll,omitempty"`
+	Jitter     float64       `json:"jitter,omitempty"`
+	Source     string        `json:"source,omitempty"`
+	Args       []string      `json:"args,omitempty"`
+	PID        int           `json:"pid"`
+	ParentPID  int           `json:"ppid,omitempty"`
+	Hostname   string        `json:"hostname,omitempty"`
+	GOMAXPROCS int           `json:"gomaxprocs"`
+	GoVersion  string        `json:"go_version"`
+	GOOS       string        `json:"goos"`
+	GOARCH     string        `json:"goarch"`
+	Main       *module       `json:"main,omitempty"`
+	Modules    []*module     `json:"modules,omitempty"`
+}
+
+// module is a Go module compiled into the sampled binary.
+type module struct {
+	Path    string `json:"path"`
+	Version string `json:"version,omitempty"`
+}
+
+// newHeader describes the current process.
+func newHeader(c Config) *header {
+	h := &header{
+		Start:      time.Now(),
+		Poll:       c.Poll,
+		Jitter:     c.Jitter,
+		Source:     c.SourceName,
+		Args:       os.Args,
+		PID:        os.Getpid(),
+		ParentPID:  os.Getppid(),
+		GOMAXPROCS: runtime.GOMAXPROCS(0),
+		GoVersion:  runtime.Version(),
+		GOOS:       runtime.GOOS,
+		GOARCH:     runtime.GOARCH,
+	}
+
+	if c.Adaptive {
+		p := newPoller(c)
+		h.MinPoll = p.min
+		h.MaxPoll = p.max
+	}
+
+	if hostname, err := os.Hostname(); err == nil {
+		h.Hostname = hostname
+	}
+
+	if bi, ok := debug.ReadBuildInfo(); ok {
+		h.Main = &module{Path: bi.Main.Path, Version: bi.Main.Version}
+
+		for _, d := range bi.Deps {
+			h.Modules = append(h.Modules, &module{Path: d.Path, Version: d.Version})
+		}
+	}
+
+	return h
+}
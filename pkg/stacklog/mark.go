@@ -0,0 +1,107 @@
+/*
+Copyright 2020 Google LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package stacklog
+
+import (
+	"sync"
+	"time"
+)
+
+var (
+	// active is the most recently started stack logger, used by the package-level marker functions
+	active   *Stacklog
+	activeMu sync.Mutex
+)
+
+// event is an annotation recorded by the program under observation.
+type event struct {
+	T int64 `json:"t"`
+	// Mono is the time since the stack logger started, on the monotonic clock
+	Mono int64  `json:"m"`
+	Kind string `json:"kind"`
+	Name string `json:"name"`
+}
+
+// Mark records an instantaneous event, such as "kubelet ready", in the active stack log.
+func Mark(name string) {
+	activeLog().Mark(name)
+}
+
+// Begin records the start of a phase, such as "pulling image", in the active stack log.
+func Begin(name string) {
+	activeLog().Begin(name)
+}
+
+// End records the end of a phase started by Begin in the active stack log.
+func End(name string) {
+	activeLog().End(name)
+}
+
+// Mark records an instantaneous event in the stack log.
+func (s *Stacklog) Mark(name string) {
+	s.record("mark", name)
+}
+
+// Begin records the start of a phase in the stack log.
+func (s *Stacklog) Begin(name string) {
+	s.record("begin", name)
+}
+
+// End records the end of a phase started by Begin in the stack log.
+func (s *Stacklog) End(name string) {
+	s.record("end", name)
+}
+
+// record queues an event to be written alongside the next sample.
+func (s *Stacklog) record(kind string, name string) {
+	if s == nil || s.timer == nil {
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.closed {
+		return
+	}
+
+	now := time.Now()
+	s.events = append(s.events, event{T: now.UnixNano(), Mono: now.Sub(s.header.Start).Nanoseconds(), Kind: kind, Name: name})
+}
+
+// setActive makes s the target of the package-level marker functions.
+func setActive(s *Stacklog) {
+	activeMu.Lock()
+	active = s
+	activeMu.Unlock()
+}
+
+// clearActive stops s from being the target of the package-level marker functions.
+func clearActive(s *Stacklog) {
+	activeMu.Lock()
+	if active == s {
+		active = nil
+	}
+	activeMu.Unlock()
+}
+
+func activeLog() *Stacklog {
+	activeMu.Lock()
+	defer activeMu.Unlock()
+
+	return active
+}
@@ -0,0 +1,124 @@
+/*
+Copyright 2020 Google LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package stacklog
+
+import (
+	"math"
+	"runtime/metrics"
+)
+
+// DefaultMetrics are the runtime/metrics recorded alongside each sample by MustStartFromEnv when STACKLOG_METRICS
+// is true.
+var DefaultMetrics = []string{
+	"/gc/heap/live:bytes",
+	"/gc/pauses:seconds",
+	"/sched/goroutines:goroutines",
+	"/sched/latencies:seconds",
+}
+
+// metricsSampler reads a set of runtime/metrics. Histograms are recorded as the 99th percentile of the
+// observations made since the previous read.
+type metricsSampler struct {
+	samples []metrics.Sample
+	prev    map[string][]uint64
+}
+
+// newMetricsSampler returns a sampler for the named metrics, skipping any this Go release does not support.
+func newMetricsSampler(names []string) *metricsSampler {
+	supported := map[string]bool{}
+	for _, d := range metrics.All() {
+		supported[d.Name] = true
+	}
+
+	m := &metricsSampler{prev: map[string][]uint64{}}
+
+	for _, n := range names {
+		if supported[n] {
+			m.samples = append(m.samples, metrics.Sample{Name: n})
+		}
+	}
+
+	if len(m.samples) == 0 {
+		return nil
+	}
+
+	return m
+}
+
+// read returns the current value of each metric.
+func (m *metricsSampler) read() map[string]float64 {
+	if m == nil {
+		return nil
+	}
+
+	metrics.Read(m.samples)
+
+	vals := map[string]float64{}
+
+	for _, s := range m.samples {
+		switch s.Value.Kind() {
+		case metrics.KindUint64:
+			vals[s.Name] = float64(s.Value.Uint64())
+		case metrics.KindFloat64:
+			vals[s.Name] = s.Value.Float64()
+		case metrics.KindFloat64Histogram:
+			h := s.Value.Float64Histogram()
+			vals[s.Name] = percentile(h, m.prev[s.Name], 0.99)
+			m.prev[s.Name] = append([]uint64{}, h.Counts...)
+		}
+	}
+
+	return vals
+}
+
+// percentile estimates a percentile of the observations in h which are not in the earlier counts prev.
+func percentile(h *metrics.Float64Histogram, prev []uint64, p float64) float64 {
+	delta := make([]uint64, len(h.Counts))
+	total := uint64(0)
+
+	for i, c := range h.Counts {
+		delta[i] = c
+		if i < len(prev) {
+			delta[i] -= prev[i]
+		}
+
+		total += delta[i]
+	}
+
+	if total == 0 {
+		return 0
+	}
+
+	threshold := uint64(math.Ceil(float64(total) * p))
+	seen := uint64(0)
+
+	for i, c := range delta {
+		seen += c
+		if seen < threshold {
+			continue
+		}
+
+		// Buckets[i] and Buckets[i+1] bound this bucket; the outermost may be infinite
+		if hi := h.Buckets[i+1]; !math.IsInf(hi, 0) {
+			return hi
+		}
+
+		return h.Buckets[i]
+	}
+
+	return 0
+}
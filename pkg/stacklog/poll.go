@@ -0,0 +1,120 @@
+/*
+Copyright 2020 Google LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package stacklog
+
+import (
+	"fmt"
+	"hash/fnv"
+	"math/rand/v2"
+	"strconv"
+	"time"
+)
+
+// poller chooses how long to wait before each sample.
+type poller struct {
+	poll   time.Duration
+	jitter float64
+
+	// adaptive polling halves the interval while stacks are changing, and doubles it while they are static
+	adaptive bool
+	min      time.Duration
+	max      time.Duration
+	interval time.Duration
+	last     uint64
+}
+
+// newPoller returns a poller for the configured poll interval.
+func newPoller(c Config) *poller {
+	p := &poller{poll: c.Poll, jitter: c.Jitter, adaptive: c.Adaptive, min: c.MinPoll, max: c.MaxPoll, interval: c.Poll}
+
+	if p.min == 0 {
+		p.min = c.Poll / 8
+	}
+
+	if p.max == 0 {
+		p.max = c.Poll * 8
+	}
+
+	return p
+}
+
+// next returns how long to wait before the next sample.
+func (p *poller) next() time.Duration {
+	d := p.poll
+	if p.adaptive {
+		d = p.interval
+	}
+
+	if p.jitter > 0 {
+		d += time.Duration((rand.Float64()*2 - 1) * p.jitter * float64(d))
+	}
+
+	if d < time.Millisecond {
+		d = time.Millisecond
+	}
+
+	return d
+}
+
+// observe adapts the interval to whether the stacks have changed since the previous sample.
+func (p *poller) observe(stacks []byte) {
+	if !p.adaptive {
+		return
+	}
+
+	fp := fingerprint(stacks)
+
+	if fp != p.last {
+		p.interval = max(p.min, p.interval/2)
+	} else {
+		p.interval = min(p.max, p.interval*2)
+	}
+
+	p.last = fp
+}
+
+// fingerprint hashes the call stacks of every goroutine, ignoring their headers, which include ever-growing wait
+// times.
+func fingerprint(stacks []byte) uint64 {
+	h := fnv.New64a()
+
+	for _, g := range splitGoroutines(stacks) {
+		h.Write(strconv.AppendInt(nil, int64(g.id), 10))
+
+		for _, f := range g.frames {
+			h.Write([]byte(f))
+		}
+
+		h.Write([]byte{0})
+	}
+
+	return h.Sum64()
+}
+
+// String describes the poll interval, for messages.
+func (p *poller) String() string {
+	s := p.poll.String()
+	if p.adaptive {
+		s = fmt.Sprintf("%s-%s adaptively", p.min, p.max)
+	}
+
+	if p.jitter > 0 {
+		s = fmt.Sprintf("%s ±%.0f%%", s, p.jitter*100)
+	}
+
+	return s
+}
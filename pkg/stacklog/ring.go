@@ -0,0 +1,91 @@
+/*
+Copyright 2020 Google LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package stacklog
+
+import (
+	"time"
+)
+
+// sample is a single stack dump taken at a point in time.
+type sample struct {
+	t      time.Time
+	stacks []byte
+	// events were recorded since the previous sample
+	events []event
+	// metrics are runtime/metrics values read alongside the stacks
+	metrics map[string]float64
+	// pause is how long capturing the stacks took, during which the world was stopped
+	pause time.Duration
+	// overhead is the total time taken to record the sample, if known when it was taken
+	overhead time.Duration
+	// fetches are the attempts to fetch stacks from Config.Source since the previous sample, ending with this one
+	fetches []fetch
+}
+
+// fetch is an attempt to fetch stacks from Config.Source, which may have failed.
+type fetch struct {
+	T int64 `json:"t"`
+	// Mono is the time since the stack logger started, on the monotonic clock
+	Mono int64 `json:"m"`
+	// D is how long the attempt took
+	D   int64  `json:"d"`
+	Err string `json:"err,omitempty"`
+}
+
+// newFetch describes an attempt to fetch stacks which began at t and took d, by a logger which started at start.
+func newFetch(start time.Time, t time.Time, d time.Duration, err error) fetch {
+	f := fetch{T: t.UnixNano(), Mono: t.Sub(start).Nanoseconds(), D: d.Nanoseconds()}
+	if err != nil {
+		f.Err = err.Error()
+	}
+
+	return f
+}
+
+// ring is a bounded, in-memory history of the most recent samples.
+type ring struct {
+	maxAge     time.Duration
+	maxSamples int
+	samples    []sample
+}
+
+// push adds a sample, evicting any that fall outside of the ring bounds.
+func (r *ring) push(s sample) {
+	r.samples = append(r.samples, s)
+
+	drop := 0
+	if r.maxSamples > 0 && len(r.samples) > r.maxSamples {
+		drop = len(r.samples) - r.maxSamples
+	}
+
+	if r.maxAge > 0 {
+		cutoff := s.t.Add(-r.maxAge)
+		for drop < len(r.samples) && r.samples[drop].t.Before(cutoff) {
+			drop++
+		}
+	}
+
+	if drop > 0 {
+		// Copy rather than reslice so that the backing array stays bounded
+		r.samples = append(r.samples[:0], r.samples[drop:]...)
+	}
+}
+
+// snapshot returns a copy of the samples currently held, oldest first.
+func (r *ring) snapshot() []sample {
+	return append([]sample{}, r.samples...)
+}
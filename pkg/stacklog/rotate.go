@@ -0,0 +1,122 @@
+/*
+Copyright 2020 Google LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package stacklog
+
+import (
+	"fmt"
+	"os"
+	"sync/atomic"
+	"time"
+
+	"github.com/google/slowjam/internal/logformat"
+)
+
+// countingSink counts the bytes written through it.
+type countingSink struct {
+	Sink
+	n *atomic.Int64
+}
+
+func (c countingSink) Write(p []byte) (int, error) {
+	n, err := c.Sink.Write(p)
+	c.n.Add(int64(n))
+
+	return n, err
+}
+
+// limitReached returns a description of the configured limit that has been reached, if any.
+func (s *Stacklog) limitReached() string {
+	s.mu.Lock()
+	samples := s.samples - s.onDemand
+	s.mu.Unlock()
+
+	switch {
+	case s.maxSamples > 0 && samples >= s.maxSamples:
+		return fmt.Sprintf("%d samples", s.maxSamples)
+	case s.maxSize > 0 && s.written.Load() >= s.maxSize:
+		return fmt.Sprintf("%d bytes", s.maxSize)
+	case s.maxDuration > 0 && time.Since(s.header.Start) >= s.maxDuration:
+		return s.maxDuration.String()
+	default:
+		return ""
+	}
+}
+
+// maybeRotate starts a new segment file once the current one is large or old enough. Each segment begins with its
+// own header, so that it can be read on its own.
+func (s *Stacklog) maybeRotate() {
+	if s.ring != nil || s.writer != nil {
+		return
+	}
+
+	big := s.rotateSize > 0 && s.written.Load()-s.segmentOffset >= s.rotateSize
+	old := s.rotateInterval > 0 && time.Since(s.segmentStart) >= s.rotateInterval
+
+	if !big && !old {
+		return
+	}
+
+	if err := s.nextSegment(); err != nil {
+		s.warnWrite(fmt.Errorf("rotate: %w", err))
+		return
+	}
+
+	if !s.quiet {
+		fmt.Fprintf(os.Stderr, "stacklog: rotated to %s\n", logformat.SegmentPath(s.path, s.segment))
+	}
+}
+
+// nextSegment closes the current segment file, if open, and starts logging to the next.
+func (s *Stacklog) nextSegment() error {
+	// Open the next segment before closing this one, so that a failure leaves logging to the current segment
+	sink, err := s.openSink(nil, s.segment+1, &s.written)
+	if err != nil {
+		return err
+	}
+
+	if s.sink != nil {
+		if err := s.sink.Close(); err != nil {
+			s.warnWrite(fmt.Errorf("close: %w", err))
+		}
+	}
+
+	s.mu.Lock()
+	s.segment++
+	s.mu.Unlock()
+
+	s.sink = sink
+	s.enc = newEncoder(s.format, s.header)
+	s.segmentOffset = s.written.Load()
+	s.segmentStart = time.Now()
+
+	return nil
+}
+
+// removeStaleSegments removes the segments left behind by an earlier log at the same path, so that they are not read
+// as a continuation of this one.
+func removeStaleSegments(path string) error {
+	for n := 1; ; n++ {
+		err := os.Remove(logformat.SegmentPath(path, n))
+		if os.IsNotExist(err) {
+			return nil
+		}
+
+		if err != nil {
+			return err
+		}
+	}
+}
@@ -0,0 +1,156 @@
+/*
+Copyright 2020 Google LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package stacklog
+
+import (
+	"fmt"
+	"os"
+	"os/signal"
+	"syscall"
+
+	"github.com/google/slowjam/internal/logformat"
+)
+
+// Pause stops sampling until Resume is called. When logging to a file, the current segment is closed, so that it can
+// be read while paused.
+func (s *Stacklog) Pause() error {
+	if s == nil || s.timer == nil {
+		return nil
+	}
+
+	s.out.Lock()
+	defer s.out.Unlock()
+
+	if s.paused || s.isClosed() {
+		return nil
+	}
+
+	s.paused = true
+
+	if !s.quiet {
+		fmt.Fprintf(os.Stderr, "stacklog: paused\n")
+	}
+
+	if s.ring != nil || s.writer != nil {
+		return nil
+	}
+
+	err := s.sink.Close()
+	s.sink = nil
+
+	if err != nil {
+		return fmt.Errorf("close: %w", err)
+	}
+
+	return nil
+}
+
+// Resume resumes sampling after Pause. When logging to a file, samples are written to a new segment of the path.
+func (s *Stacklog) Resume() error {
+	if s == nil || s.timer == nil {
+		return nil
+	}
+
+	s.out.Lock()
+	defer s.out.Unlock()
+
+	if !s.paused || s.isClosed() {
+		return nil
+	}
+
+	if s.ring == nil && s.writer == nil {
+		if err := s.nextSegment(); err != nil {
+			return err
+		}
+	}
+
+	s.paused = false
+
+	if !s.quiet {
+		fmt.Fprintf(os.Stderr, "stacklog: resumed, logging to %s\n", s.segmentDest())
+	}
+
+	return nil
+}
+
+// isClosed returns whether the stack logger has been stopped.
+func (s *Stacklog) isClosed() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.closed
+}
+
+// segmentDest describes where samples are currently written, for messages.
+func (s *Stacklog) segmentDest() string {
+	if s.ring != nil {
+		return "memory"
+	}
+
+	if s.writer != nil {
+		return s.dest()
+	}
+
+	return logformat.SegmentPath(s.path, s.segment)
+}
+
+// handleSignals pauses and resumes sampling on the toggle signals, and stops the logger on SIGINT or SIGTERM. As
+// being notified of these disables their default action, they are then raised again with it restored, unless reraise
+// is unset for a program which handles them itself.
+func (s *Stacklog) handleSignals(reraise bool) {
+	sigs := make(chan os.Signal, 1)
+	watch := []os.Signal{syscall.SIGINT, syscall.SIGTERM}
+
+	if pauseSignal != nil {
+		watch = append(watch, pauseSignal, resumeSignal)
+	}
+
+	signal.Notify(sigs, watch...)
+
+	for sig := range sigs {
+		var err error
+
+		switch sig {
+		case pauseSignal:
+			err = s.Pause()
+		case resumeSignal:
+			err = s.Resume()
+		default:
+			if err := s.Stop(); err != nil {
+				fmt.Fprintf(os.Stderr, "stacklog: stop failed: %v\n", err)
+			}
+
+			signal.Stop(sigs)
+
+			if !reraise {
+				return
+			}
+
+			signal.Reset(sig)
+
+			if err := raise(sig); err != nil {
+				fmt.Fprintf(os.Stderr, "stacklog: raise %s: %v\n", sig, err)
+			}
+
+			return
+		}
+
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "stacklog: %s: %v\n", sig, err)
+		}
+	}
+}
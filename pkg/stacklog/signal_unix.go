@@ -0,0 +1,35 @@
+//go:build unix
+
+/*
+Copyright 2020 Google LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package stacklog
+
+import (
+	"os"
+	"syscall"
+)
+
+// pauseSignal and resumeSignal toggle sampling in loggers started by MustStartFromEnv.
+var (
+	pauseSignal  os.Signal = syscall.SIGUSR2
+	resumeSignal os.Signal = syscall.SIGUSR1
+)
+
+// raise sends a signal to the current process.
+func raise(sig os.Signal) error {
+	return syscall.Kill(os.Getpid(), sig.(syscall.Signal))
+}
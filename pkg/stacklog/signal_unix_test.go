@@ -0,0 +1,147 @@
+//go:build unix
+
+/*
+Copyright 2020 Google LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package stacklog
+
+import (
+	"bufio"
+	"errors"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/google/slowjam/internal/logformat"
+)
+
+// childEnv marks the test binary as a child process started by startChild.
+const childEnv = "STACKLOG_TEST_CHILD"
+
+// TestChild is run as a child process by startChild: it starts a logger from the environment, then waits to be
+// signalled, as a program with no signal handler of its own would.
+func TestChild(t *testing.T) {
+	if os.Getenv(childEnv) == "" {
+		t.Skip("only run as a child process")
+	}
+
+	MustStartFromEnv("STACKLOG_PATH")
+	os.Stdout.WriteString("ready\n")
+	time.Sleep(time.Minute)
+	os.Exit(3)
+}
+
+// startChild starts TestChild logging to path, and waits until it is sampling.
+func startChild(t *testing.T, path string, env ...string) *exec.Cmd {
+	t.Helper()
+
+	cmd := exec.Command(os.Args[0], "-test.run=^TestChild$")
+	cmd.Env = append(os.Environ(), childEnv+"=1", "STACKLOG_PATH="+path, "STACKLOG_POLL=10ms", "STACKLOG_QUIET=true")
+	cmd.Env = append(cmd.Env, env...)
+
+	out, err := cmd.StdoutPipe()
+	if err != nil {
+		t.Fatalf("stdout: %v", err)
+	}
+
+	if err := cmd.Start(); err != nil {
+		t.Fatalf("start: %v", err)
+	}
+
+	t.Cleanup(func() { _ = cmd.Process.Kill() })
+
+	line, err := bufio.NewReader(out).ReadString('\n')
+	if err != nil || line != "ready\n" {
+		t.Fatalf("child said %q: %v", line, err)
+	}
+
+	time.Sleep(50 * time.Millisecond)
+
+	return cmd
+}
+
+// wait waits for a child to exit, returning an error if it is still running after timeout.
+func wait(cmd *exec.Cmd, timeout time.Duration) error {
+	done := make(chan error, 1)
+	go func() { done <- cmd.Wait() }()
+
+	select {
+	case err := <-done:
+		return err
+	case <-time.After(timeout):
+		return errors.New("still running")
+	}
+}
+
+// checkFlushed fails unless the final sample taken by Stop was written to path.
+func checkFlushed(t *testing.T, path string) {
+	t.Helper()
+
+	bs, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("read log: %v", err)
+	}
+
+	log := string(bs)
+	if !strings.HasPrefix(log, logformat.V2Magic+"\n") || !strings.Contains(log, "(*Stacklog).shutdown") {
+		t.Errorf("log lacks the final sample taken by Stop:\n%s", log)
+	}
+}
+
+func TestSignalRaised(t *testing.T) {
+	for _, sig := range []syscall.Signal{syscall.SIGINT, syscall.SIGTERM} {
+		t.Run(sig.String(), func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "out.slog")
+			cmd := startChild(t, path)
+
+			if err := cmd.Process.Signal(sig); err != nil {
+				t.Fatalf("signal: %v", err)
+			}
+
+			err := wait(cmd, 5*time.Second)
+
+			var ee *exec.ExitError
+			if !errors.As(err, &ee) {
+				t.Fatalf("child exit = %v, want it to be killed by %s", err, sig)
+			}
+
+			if ws, ok := ee.Sys().(syscall.WaitStatus); !ok || !ws.Signaled() || ws.Signal() != sig {
+				t.Fatalf("child exit = %v, want it to be killed by %s", err, sig)
+			}
+
+			checkFlushed(t, path)
+		})
+	}
+}
+
+func TestSignalNotRaised(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "out.slog")
+	cmd := startChild(t, path, raiseEnv+"=false")
+
+	if err := cmd.Process.Signal(syscall.SIGINT); err != nil {
+		t.Fatalf("signal: %v", err)
+	}
+
+	if err := wait(cmd, 500*time.Millisecond); err == nil || err.Error() != "still running" {
+		t.Fatalf("child exit = %v, want it to keep running", err)
+	}
+
+	checkFlushed(t, path)
+}
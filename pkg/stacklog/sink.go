@@ -0,0 +1,111 @@
+/*
+Copyright 2020 Google LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package stacklog
+
+import (
+	"io"
+	"os"
+)
+
+// Sink is a destination for stack samples. Flush is called after every sample, and Close when logging stops.
+type Sink interface {
+	io.Writer
+	Flush() error
+	Close() error
+}
+
+// writerSink adapts an io.Writer into a Sink. The writer is flushed if it supports it, but never closed, as it
+// belongs to the caller.
+type writerSink struct {
+	io.Writer
+}
+
+func (w writerSink) Flush() error {
+	if f, ok := w.Writer.(interface{ Flush() error }); ok {
+		return f.Flush()
+	}
+
+	return nil
+}
+
+func (w writerSink) Close() error {
+	return w.Flush()
+}
+
+// fileSink is a Sink which syncs the file to disk before closing it.
+type fileSink struct {
+	*os.File
+}
+
+func (f fileSink) Flush() error {
+	return nil
+}
+
+func (f fileSink) Close() error {
+	if err := f.File.Sync(); err != nil {
+		f.File.Close()
+		return err
+	}
+
+	return f.File.Close()
+}
+
+// compressedSink compresses samples on their way to another sink.
+type compressedSink struct {
+	compressor
+	under Sink
+}
+
+func (c compressedSink) Flush() error {
+	if err := c.compressor.Flush(); err != nil {
+		return err
+	}
+
+	return c.under.Flush()
+}
+
+func (c compressedSink) Close() error {
+	if err := c.compressor.Close(); err != nil {
+		c.under.Close()
+		return err
+	}
+
+	return c.under.Close()
+}
+
+// asSink returns w as a Sink, adapting it if necessary.
+func asSink(w io.Writer) Sink {
+	if s, ok := w.(Sink); ok {
+		return s
+	}
+
+	return writerSink{w}
+}
+
+// compress wraps a sink with the requested compression.
+func compress(s Sink, c Compression) (Sink, error) {
+	if c == CompressionAuto || c == CompressionNone {
+		return s, nil
+	}
+
+	cw, err := newCompressor(s, c)
+	if err != nil {
+		return nil, err
+	}
+
+	return compressedSink{compressor: cw, under: s}, nil
+}
@@ -18,13 +18,19 @@ limitations under the License.
 package stacklog
 
 import (
+	"context"
+	"errors"
 	"fmt"
-	"io/ioutil"
+	"io"
+	"net/http"
 	"os"
 	"os/signal"
 	"runtime"
-	"syscall"
+	"sync"
+	"sync/atomic"
 	"time"
+
+	"github.com/google/slowjam/internal/logformat"
 )
 
 var (
@@ -37,9 +43,68 @@ var (
 
 // Config defines how to configure a stack logger.
 type Config struct {
-	Path  string
-	Poll  time.Duration
-	Quiet bool
+	// Path is the file to log to. It may contain placeholders: %p for the process ID, %t for the start time, %h for
+	// the hostname, and %% for a literal %.
+	Path string
+	// Writer, if set, receives stack samples instead of Path, for example a pipe, socket, or in-memory buffer. If it
+	// implements Sink, it is flushed after every sample and closed by Stop. Otherwise, it is flushed if it has a
+	// Flush method, and left open.
+	Writer io.Writer
+	Poll   time.Duration
+	Quiet  bool
+	// Compression selects the output compression. By default, it is chosen by the suffix of Path, and Writer is
+	// left uncompressed.
+	Compression Compression
+	// Format selects the stack log format. By default, only goroutines which changed between samples are written.
+	Format Format
+	// Metrics are runtime/metrics names to record alongside each sample, such as DefaultMetrics. Histograms are
+	// recorded as the 99th percentile of observations made since the previous sample.
+	Metrics []string
+
+	// RingDuration enables flight-recorder mode: only samples from this recent window are kept in memory, and
+	// they are written to Path when Trigger is called.
+	RingDuration time.Duration
+	// RingSamples enables flight-recorder mode, keeping at most this many recent samples in memory.
+	RingSamples int
+	// TriggerSignal, if set, calls Trigger whenever the process receives this signal.
+	TriggerSignal os.Signal
+
+	// Include, if set, only records goroutines matching at least one of these rules.
+	Include []Rule
+	// Exclude skips goroutines matching any of these rules, which shrinks the log at the source.
+	Exclude []Rule
+
+	// Jitter randomizes each interval between samples by up to this fraction of it, such as 0.1 for 10%, so that
+	// sampling does not alias with periodic work.
+	Jitter float64
+	// Adaptive samples faster while stacks are changing, and backs off while they are static. The interval between
+	// samples stays within MinPoll and MaxPoll, which default to Poll/8 and Poll*8.
+	Adaptive bool
+	MinPoll  time.Duration
+	MaxPoll  time.Duration
+
+	// MaxSize stops logging once this many bytes have been written. The sample which crosses it is kept. Dumps
+	// written by Trigger do not count towards it.
+	MaxSize int64
+	// MaxSamples stops logging once this many samples have been taken. Samples taken on demand by Trigger and
+	// ServeHTTP do not count towards it.
+	MaxSamples int
+	// MaxDuration stops logging once this much time has passed since Start.
+	MaxDuration time.Duration
+
+	// RotateSize starts a new segment of Path once the current one reaches this many bytes. Segments are numbered
+	// before the file extension: out.slog, out.1.slog, out.2.slog, and so on. Segments left by an earlier log at
+	// the same path are removed by Start.
+	RotateSize int64
+	// RotateInterval starts a new segment of Path once the current one is this old.
+	RotateInterval time.Duration
+
+	// Source, if set, returns the stacks to record in place of those of this process, in the format of
+	// runtime.Stack, such as goroutine dumps fetched from another process. The time each call takes is recorded as
+	// a fetch, rather than a pause. Samples for which it fails are skipped, but the failed fetch is recorded.
+	Source func() ([]byte, error)
+	// SourceName describes Source in the log header, such as the URL it fetches dumps from.
+	SourceName string
 }
 
 // Start begins logging stacks to an output file.
@@ -48,90 +113,534 @@ func Start(c Config) (*Stacklog, error) {
 		c.Poll = defaultPoll
 	}
 
-	if c.Path == "" {
-		tf, err := ioutil.TempFile("", "*.slog")
+	// Stacks from another process may carry labels even if this one's don't
+	if c.Source == nil && hasLabelRule(c.Include, c.Exclude) && !tracebackLabels() {
+		return nil, errors.New("label rules need goroutine labels in tracebacks: run with GODEBUG=tracebacklabels=1 on Go 1.27 or later")
+	}
+
+	h := newHeader(c)
+	c.Path = expandPath(c.Path, h.Start)
+
+	if c.Path == "" && c.Writer == nil {
+		tf, err := os.CreateTemp("", "*.slog")
 		if err != nil {
 			return nil, fmt.Errorf("default path: %w", err)
 		}
 
+		// Only the name is needed, as the path is opened again for writing
 		c.Path = tf.Name()
+		if err := tf.Close(); err != nil {
+			return nil, fmt.Errorf("default path: %w", err)
+		}
+	}
+
+	s := &Stacklog{
+		path:        c.Path,
+		writer:      c.Writer,
+		quiet:       c.Quiet,
+		compression: compressionFor(c.Compression, c.Path),
+		format:      c.Format,
+		header:      h,
+		source:      func() ([]byte, error) { return DumpStacks(), nil },
+		metrics:     newMetricsSampler(c.Metrics),
+		poller:      newPoller(c),
+		filter:      newFilter(c.Include, c.Exclude),
+
+		maxSize:        c.MaxSize,
+		maxSamples:     c.MaxSamples,
+		maxDuration:    c.MaxDuration,
+		rotateSize:     c.RotateSize,
+		rotateInterval: c.RotateInterval,
+		segmentStart:   time.Now(),
 	}
 
-	if !c.Quiet {
-		fmt.Fprintf(os.Stderr, "stacklog: logging to %s, sampling every %s\n", c.Path, c.Poll)
+	if c.Source != nil {
+		s.source = c.Source
+		s.remote = true
 	}
 
-	s := &Stacklog{
-		ticker: time.NewTicker(c.Poll),
-		path:   c.Path,
-		quiet:  c.Quiet,
+	s.enc = newEncoder(c.Format, s.header)
+
+	if c.RingDuration > 0 || c.RingSamples > 0 {
+		if !c.Quiet {
+			fmt.Fprintf(os.Stderr, "stacklog: recording to memory, sampling every %s. trigger to write to %s\n", s.poller, s.dest())
+		}
+
+		s.ring = &ring{maxAge: c.RingDuration, maxSamples: c.RingSamples}
+	} else {
+		if !c.Quiet {
+			fmt.Fprintf(os.Stderr, "stacklog: logging to %s, sampling every %s\n", s.dest(), s.poller)
+		}
+
+		if c.Writer == nil {
+			if err := removeStaleSegments(c.Path); err != nil {
+				return s, fmt.Errorf("remove stale segments: %w", err)
+			}
+		}
+
+		sink, err := s.openSink(asSink(c.Writer), 0, &s.written)
+		if err != nil {
+			return s, err
+		}
+
+		s.sink = sink
 	}
 
-	f, err := os.Create(c.Path)
+	if c.TriggerSignal != nil {
+		s.sigs = make(chan os.Signal, 1)
+		signal.Notify(s.sigs, c.TriggerSignal)
+
+		go s.triggerOnSignal()
+	}
+
+	s.timer = time.NewTimer(s.poller.next())
+	s.stop = make(chan struct{})
+	s.done = make(chan struct{})
+
+	go s.loop()
+
+	setActive(s)
+
+	return s, nil
+}
+
+// StartContext begins logging stacks to an output file, stopping when the context is canceled.
+func StartContext(ctx context.Context, c Config) (*Stacklog, error) {
+	s, err := Start(c)
 	if err != nil {
 		return s, err
 	}
 
-	s.f = f
-	go s.loop()
+	go func() {
+		select {
+		case <-ctx.Done():
+			if err := s.Stop(); err != nil && !s.quiet {
+				fmt.Fprintf(os.Stderr, "stacklog: stop failed: %v\n", err)
+			}
+		case <-s.done:
+		}
+	}()
 
 	return s, nil
 }
 
-// MustStartFromEnv logs stacks to an output file based on the environment.
+// MustStartFromEnv logs stacks to an output file based on the environment. The path may contain placeholders, as
+// described by Config.Path. STACKLOG_POLL, STACKLOG_QUIET and STACKLOG_MAX_SIZE (such as "512M") override the
+// defaults, and STACKLOG_METRICS records runtime/metrics: DefaultMetrics if true, or a comma-separated list of
+// names. If STACKLOG_CHILDREN is true, child processes which inherit the environment write to sibling files, rather
+// than overwriting the same one.
+//
+// On Unix, SIGUSR2 pauses sampling and SIGUSR1 resumes it in a new segment. SIGINT and SIGTERM stop the logger, and
+// are then raised again with their default action, so that the program exits as it would have otherwise. Programs
+// which handle them to shut down gracefully should set STACKLOG_RAISE to false, and call Stop themselves.
 func MustStartFromEnv(key string) *Stacklog {
 	val := os.Getenv(key)
 	if val == "" {
 		return &Stacklog{}
 	}
 
-	s, err := Start(Config{Path: val, Quiet: defaultQuiet, Poll: defaultPoll})
+	c, err := configFromEnv(val)
 	if err != nil {
 		panic(fmt.Sprintf("stacklog from environment %q: %v", key, err))
 	}
 
-	sigs := make(chan os.Signal, 1)
-	signal.Notify(sigs, syscall.SIGINT, syscall.SIGTERM)
+	if err := propagateToChildren(key, val); err != nil {
+		panic(fmt.Sprintf("stacklog from environment %q: %v", key, err))
+	}
 
-	go func() {
-		<-sigs
-		s.Stop()
-	}()
+	reraise, err := raiseFromEnv()
+	if err != nil {
+		panic(fmt.Sprintf("stacklog from environment %q: %v", key, err))
+	}
+
+	s, err := Start(c)
+	if err != nil {
+		panic(fmt.Sprintf("stacklog from environment %q: %v", key, err))
+	}
+
+	go s.handleSignals(reraise)
 
 	return s
 }
 
 // Stacklog controls the stack logger.
 type Stacklog struct {
-	ticker  *time.Ticker
-	f       *os.File
-	quiet   bool
-	path    string
-	samples int
+	timer       *time.Timer
+	sink        Sink
+	writer      io.Writer
+	compression Compression
+	format      Format
+	header      *header
+	enc         encoder
+	source      func() ([]byte, error)
+	metrics     *metricsSampler
+	poller      *poller
+	filter      *filter
+	quiet       bool
+	path        string
+	samples     int
+
+	// remote is set when stacks come from Config.Source rather than this process
+	remote bool
+
+	// written counts the bytes written to the output, across all segments
+	written        atomic.Int64
+	maxSize        int64
+	maxSamples     int
+	maxDuration    time.Duration
+	rotateSize     int64
+	rotateInterval time.Duration
+	// segment is the number of the segment being written, which began at segmentOffset bytes and segmentStart
+	segment       int
+	segmentOffset int64
+	segmentStart  time.Time
+	// limit describes the limit which stopped logging, if any
+	limit string
+
+	// out guards the output, poller and paused state, which Pause, Resume and Trigger change while sampling
+	out    sync.Mutex
+	paused bool
+
+	// stop asks the sampling loop to exit, and done is closed once it has
+	stop     chan struct{}
+	done     chan struct{}
+	stopOnce sync.Once
+	stopErr  error
+	// writeErr is the first error encountered while writing samples
+	writeErr error
+
+	// mu guards the sample and segment counts, including samples taken on demand, pending events and fetches, and
+	// ring, which is only set in flight-recorder mode
+	mu       sync.Mutex
+	onDemand int
+	ring     *ring
+	events   []event
+	fetches  []fetch
+	sigs     chan os.Signal
+	closed   bool
+
+	// trigger serializes Trigger, and triggered is the time of the newest sample it has appended to the writer, which
+	// is closed by Stop if it is a Sink
+	trigger      sync.Mutex
+	triggered    time.Time
+	writerClosed bool
 }
 
-// loop periodically records the stack log to disk.
+// loop periodically records the stack log to disk, or to the ring in flight-recorder mode.
 func (s *Stacklog) loop() {
-	for range s.ticker.C {
-		if _, err := s.f.Write([]byte(fmt.Sprintf("%d\n", time.Now().UnixNano()))); err != nil {
-			if !s.quiet {
-				fmt.Fprintf(os.Stderr, "stacklog: write failed: %v", err)
+	defer close(s.done)
+
+	for {
+		select {
+		case <-s.stop:
+			return
+		case <-s.timer.C:
+			if !s.tick() {
+				go s.Stop()
+				return
 			}
+
+			// Trigger may sample, and adapt the interval, at any time
+			s.out.Lock()
+			next := s.poller.next()
+			s.out.Unlock()
+
+			s.timer.Reset(next)
 		}
+	}
+}
 
-		if _, err := s.f.Write(DumpStacks()); err != nil {
-			if !s.quiet {
-				fmt.Fprintf(os.Stderr, "stacklog: write failed: %v", err)
-			}
+// tick takes a scheduled sample unless paused, returning false once a limit has been reached.
+func (s *Stacklog) tick() bool {
+	s.out.Lock()
+	defer s.out.Unlock()
+
+	if s.paused {
+		return true
+	}
+
+	if limit := s.limitReached(); limit != "" {
+		s.limit = limit
+
+		if !s.quiet {
+			fmt.Fprintf(os.Stderr, "stacklog: reached limit of %s\n", limit)
 		}
 
-		if _, err := s.f.Write([]byte("-\n")); err != nil {
-			if !s.quiet {
-				fmt.Fprintf(os.Stderr, "stacklog: write failed: %v", err)
-			}
+		return false
+	}
+
+	s.takeSample()
+	s.maybeRotate()
+
+	return true
+}
+
+// takeSample takes and records a single stack sample. It is only called by one goroutine at a time.
+func (s *Stacklog) takeSample() {
+	sm := sample{t: time.Now()}
+
+	stacks, err := s.source()
+	took := time.Since(sm.t)
+
+	if err != nil {
+		s.failedFetch(sm.t, took, err)
+		return
+	}
+
+	// Stacks fetched from elsewhere don't stop the world, but the time taken to fetch them skews the sample
+	if s.remote {
+		sm.fetches = []fetch{newFetch(s.header.Start, sm.t, took, nil)}
+	} else {
+		sm.pause = took
+	}
+
+	sm.stacks = s.filter.apply(stacks)
+	sm.metrics = s.metrics.read()
+	s.poller.observe(sm.stacks)
+
+	s.mu.Lock()
+	sm.events = s.events
+	s.events = nil
+	sm.fetches = append(s.fetches, sm.fetches...)
+	s.fetches = nil
+	s.samples++
+
+	if s.ring != nil {
+		sm.overhead = time.Since(sm.t)
+		s.ring.push(sm)
+		s.mu.Unlock()
+
+		return
+	}
+
+	s.mu.Unlock()
+
+	if _, err := s.enc.encode(s.sink, sm); err != nil {
+		s.warnWrite(fmt.Errorf("write: %w", err))
+	}
+
+	// Flush every sample so that a killed process still leaves a readable log
+	if err := s.sink.Flush(); err != nil {
+		s.warnWrite(fmt.Errorf("flush: %w", err))
+	}
+
+	// The overhead of this sample is only known once it has been written, so it follows the sample, and is
+	// flushed with the next one
+	if err := s.enc.encodeOverhead(s.sink, time.Since(sm.t), sm.pause); err != nil {
+		s.warnWrite(fmt.Errorf("write: %w", err))
+	}
+}
+
+// failedFetch records a failed attempt to fetch stacks from Config.Source. In flight-recorder mode it is kept with
+// the next sample, and otherwise written right away, so that a source which stays unreachable is still visible.
+func (s *Stacklog) failedFetch(t time.Time, took time.Duration, err error) {
+	if !s.quiet {
+		fmt.Fprintf(os.Stderr, "stacklog: skipped sample: %v\n", err)
+	}
+
+	f := newFetch(s.header.Start, t, took, err)
+
+	s.mu.Lock()
+
+	if s.ring != nil {
+		s.fetches = append(s.fetches, f)
+		s.mu.Unlock()
+
+		return
+	}
+
+	s.mu.Unlock()
+
+	if err := s.enc.encodeFetch(s.sink, f); err != nil {
+		s.warnWrite(fmt.Errorf("write: %w", err))
+	}
+
+	if err := s.sink.Flush(); err != nil {
+		s.warnWrite(fmt.Errorf("flush: %w", err))
+	}
+}
+
+// warnWrite reports a write failure, remembering the first one so that Stop can return it.
+func (s *Stacklog) warnWrite(err error) {
+	if s.writeErr == nil {
+		s.writeErr = err
+	}
+
+	if !s.quiet {
+		fmt.Fprintf(os.Stderr, "stacklog: %v\n", err)
+	}
+}
+
+// dest describes where samples are written, for messages.
+func (s *Stacklog) dest() string {
+	if s.writer != nil {
+		return "writer"
+	}
+
+	return s.path
+}
+
+// openSink opens the configured output, or a numbered segment of the path, compressing it if necessary, and counting
+// the bytes written to it in n, if set. w is used if
+// a writer was configured.
+func (s *Stacklog) openSink(w Sink, segment int, n *atomic.Int64) (Sink, error) {
+	if s.writer == nil {
+		f, err := os.Create(logformat.SegmentPath(s.path, segment))
+		if err != nil {
+			return nil, err
+		}
+
+		w = fileSink{f}
+	}
+
+	if n != nil {
+		w = countingSink{Sink: w, n: n}
+	}
+
+	cs, err := compress(w, s.compression)
+	if err != nil {
+		w.Close()
+		return nil, err
+	}
+
+	return cs, nil
+}
+
+// WriteTo writes the samples currently held in flight-recorder mode to w.
+func (s *Stacklog) WriteTo(w io.Writer) (int64, error) {
+	if s == nil || s.ring == nil {
+		return 0, errors.New("stacklog: not in flight-recorder mode")
+	}
+
+	n, _, err := s.writeRing(w, time.Time{})
+
+	return n, err
+}
+
+// writeRing writes the samples held which were taken after since to w, returning the time of the newest one written.
+func (s *Stacklog) writeRing(w io.Writer, since time.Time) (int64, time.Time, error) {
+	s.mu.Lock()
+	samples := s.ring.snapshot()
+	s.mu.Unlock()
+
+	var total int64
+
+	enc := newEncoder(s.format, s.header)
+
+	for _, sm := range samples {
+		if !sm.t.After(since) {
+			continue
 		}
 
-		s.samples++
+		n, err := enc.encode(w, sm)
+		total += n
+
+		if err != nil {
+			return total, since, err
+		}
+
+		if err := enc.encodeOverhead(w, sm.overhead, sm.pause); err != nil {
+			return total, since, err
+		}
+
+		since = sm.t
+	}
+
+	return total, since, nil
+}
+
+// sampleNow records a sample of the current state in flight-recorder mode, so that a dump includes markers recorded
+// since the last scheduled sample.
+func (s *Stacklog) sampleNow() {
+	if !s.running() {
+		return
+	}
+
+	s.out.Lock()
+	defer s.out.Unlock()
+
+	if !s.paused {
+		s.takeSample()
+
+		s.mu.Lock()
+		s.onDemand++
+		s.mu.Unlock()
+	}
+}
+
+// Trigger writes the samples held in flight-recorder mode to the configured path, replacing any earlier dump. If a
+// writer was configured instead, the samples taken since the previous trigger are appended to it, and it is left
+// open for later triggers. The current state is sampled first, along with any pending markers.
+func (s *Stacklog) Trigger() error {
+	if s == nil || s.ring == nil {
+		return errors.New("stacklog: not in flight-recorder mode")
+	}
+
+	// Signals, HTTP handlers and the program may all trigger at once, but share a single output
+	s.trigger.Lock()
+	defer s.trigger.Unlock()
+
+	if s.writerClosed {
+		return errors.New("stacklog: writer was closed by Stop")
+	}
+
+	s.sampleNow()
+
+	since := time.Time{}
+	if s.writer != nil {
+		since = s.triggered
+	}
+
+	// Dumps are taken on demand, so they don't count towards MaxSize
+	sink, err := s.openSink(writerSink{s.writer}, 0, nil)
+	if err != nil {
+		return err
+	}
+
+	_, newest, err := s.writeRing(sink, since)
+	if err != nil {
+		sink.Close()
+		return fmt.Errorf("write: %w", err)
+	}
+
+	if err := sink.Close(); err != nil {
+		return fmt.Errorf("close: %w", err)
+	}
+
+	if s.writer != nil {
+		s.triggered = newest
+	}
+
+	if !s.quiet {
+		fmt.Fprintf(os.Stderr, "stacklog: triggered. wrote recent samples to %s\n", s.dest())
+	}
+
+	return nil
+}
+
+// ServeHTTP responds with the samples held in flight-recorder mode, so that a hit can trigger a download.
+func (s *Stacklog) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if s == nil || s.ring == nil {
+		http.Error(w, "stacklog: not in flight-recorder mode", http.StatusNotFound)
+		return
+	}
+
+	s.sampleNow()
+
+	w.Header().Set("Content-Type", "application/octet-stream")
+	w.Header().Set("Content-Disposition", `attachment; filename="stacklog.slog"`)
+
+	if _, err := s.WriteTo(w); err != nil && !s.quiet {
+		fmt.Fprintf(os.Stderr, "stacklog: http write failed: %v\n", err)
+	}
+}
+
+// triggerOnSignal calls Trigger each time the trigger signal is received.
+func (s *Stacklog) triggerOnSignal() {
+	for range s.sigs {
+		if err := s.Trigger(); err != nil && !s.quiet {
+			fmt.Fprintf(os.Stderr, "stacklog: trigger failed: %v\n", err)
+		}
 	}
 }
 
@@ -149,15 +658,101 @@ func DumpStacks() []byte {
 	}
 }
 
-// Stop stops logging stacks to disk.
-func (s *Stacklog) Stop() {
-	if s == nil || s.f == nil {
-		return
+// running returns whether the stack logger is still sampling.
+func (s *Stacklog) running() bool {
+	if s == nil || s.done == nil {
+		return false
 	}
 
-	s.ticker.Stop()
+	select {
+	case <-s.done:
+		return false
+	default:
+		return true
+	}
+}
 
-	if !s.quiet {
-		fmt.Fprintf(os.Stderr, "stacklog: stopped. stored %d samples to %s\n", s.samples, s.path)
+// Stop stops logging stacks to disk. It waits for any sample in progress, records a final sample, then flushes and
+// closes the output, returning the first error encountered while writing. It is safe to call more than once.
+func (s *Stacklog) Stop() error {
+	if s == nil || s.timer == nil {
+		return nil
 	}
+
+	s.stopOnce.Do(func() {
+		s.stopErr = s.shutdown()
+	})
+
+	return s.stopErr
+}
+
+// shutdown stops the sampling loop and closes the output.
+func (s *Stacklog) shutdown() error {
+	s.timer.Stop()
+	close(s.stop)
+	<-s.done
+
+	clearActive(s)
+
+	if s.sigs != nil {
+		signal.Stop(s.sigs)
+		close(s.sigs)
+	}
+
+	// Any Trigger in progress finishes with the writer before it is closed
+	s.trigger.Lock()
+	defer s.trigger.Unlock()
+
+	s.out.Lock()
+	defer s.out.Unlock()
+
+	// A final sample captures the state at exit, along with any pending markers, unless paused or at a limit
+	if !s.paused && s.limit == "" && s.limitReached() == "" {
+		s.takeSample()
+	}
+
+	s.mu.Lock()
+	s.closed = true
+	samples := s.samples
+	s.mu.Unlock()
+
+	if s.ring != nil {
+		// Trigger leaves a writer open between dumps, but a Sink is closed by Stop in every mode
+		if sink, ok := s.writer.(Sink); ok {
+			s.writerClosed = true
+
+			if !s.quiet {
+				fmt.Fprintf(os.Stderr, "stacklog: stopped. took %d samples, closed %s\n", samples, s.dest())
+			}
+
+			if err := sink.Close(); err != nil {
+				return fmt.Errorf("close: %w", err)
+			}
+
+			return nil
+		}
+
+		if !s.quiet {
+			fmt.Fprintf(os.Stderr, "stacklog: stopped. took %d samples, call Trigger to write recent samples to %s\n", samples, s.dest())
+		}
+
+		return nil
+	}
+
+	err := s.writeErr
+
+	// The output of a paused logger has already been closed
+	if s.sink != nil {
+		if cerr := s.sink.Close(); cerr != nil && err == nil {
+			err = fmt.Errorf("close: %w", cerr)
+		}
+	}
+
+	if !s.quiet && s.segment > 0 {
+		fmt.Fprintf(os.Stderr, "stacklog: stopped. stored %d samples to %d segments of %s\n", samples, s.segment+1, s.dest())
+	} else if !s.quiet {
+		fmt.Fprintf(os.Stderr, "stacklog: stopped. stored %d samples to %s\n", samples, s.dest())
+	}
+
+	return err
 }
@@ -0,0 +1,193 @@
+/*
+Copyright 2020 Google LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package stacklog
+
+import (
+	"bytes"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// TestTriggerAdaptive triggers dumps while the sampling loop adapts its interval, which must be run with -race to
+// be meaningful.
+func TestTriggerAdaptive(t *testing.T) {
+	var b bytes.Buffer
+
+	s, err := Start(Config{Writer: &b, Poll: 2 * time.Millisecond, Adaptive: true, RingSamples: 50, Quiet: true})
+	if err != nil {
+		t.Fatalf("start: %v", err)
+	}
+
+	var wg sync.WaitGroup
+
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+
+		go func() {
+			defer wg.Done()
+
+			for j := 0; j < 10; j++ {
+				if err := s.Trigger(); err != nil {
+					t.Errorf("trigger: %v", err)
+				}
+
+				time.Sleep(time.Millisecond)
+			}
+		}()
+	}
+
+	wg.Wait()
+
+	if err := s.Stop(); err != nil {
+		t.Fatalf("stop: %v", err)
+	}
+
+	if b.Len() == 0 {
+		t.Error("nothing was written by Trigger")
+	}
+}
+
+func TestLabelRules(t *testing.T) {
+	s, err := Start(Config{Writer: &bytes.Buffer{}, Quiet: true, Include: []Rule{{Label: "tenant=*"}}})
+
+	if tracebackLabels() {
+		if err != nil {
+			t.Fatalf("start with labels in tracebacks: %v", err)
+		}
+
+		s.Stop()
+
+		return
+	}
+
+	if err == nil || !strings.Contains(err.Error(), "tracebacklabels") {
+		t.Fatalf("start without labels in tracebacks = %v, want an error naming GODEBUG=tracebacklabels", err)
+	}
+}
+
+// closeRecorder is a Sink which records whether it was closed.
+type closeRecorder struct {
+	bytes.Buffer
+	closed bool
+}
+
+func (c *closeRecorder) Flush() error {
+	return nil
+}
+
+func (c *closeRecorder) Close() error {
+	c.closed = true
+	return nil
+}
+
+func TestRingClosesSink(t *testing.T) {
+	w := &closeRecorder{}
+
+	s, err := Start(Config{Writer: w, Poll: time.Hour, RingSamples: 10, Quiet: true})
+	if err != nil {
+		t.Fatalf("start: %v", err)
+	}
+
+	if err := s.Trigger(); err != nil {
+		t.Fatalf("trigger: %v", err)
+	}
+
+	if err := s.Stop(); err != nil {
+		t.Fatalf("stop: %v", err)
+	}
+
+	if !w.closed || w.Len() == 0 {
+		t.Errorf("after Stop, writer closed = %t with %d bytes, want it closed after the dump", w.closed, w.Len())
+	}
+
+	if err := s.Trigger(); err == nil {
+		t.Error("Trigger after Stop wrote to a closed writer")
+	}
+}
+
+func TestTriggerLimits(t *testing.T) {
+	tests := []struct {
+		name string
+		c    Config
+	}{
+		{name: "size", c: Config{MaxSize: 1}},
+		{name: "samples", c: Config{MaxSamples: 4}},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			c := tc.c
+			c.Writer = &bytes.Buffer{}
+			c.Poll = 20 * time.Millisecond
+			c.RingSamples = 10
+			c.Quiet = true
+
+			s, err := Start(c)
+			if err != nil {
+				t.Fatalf("start: %v", err)
+			}
+			defer s.Stop()
+
+			for i := 0; i < 8; i++ {
+				if err := s.Trigger(); err != nil {
+					t.Fatalf("trigger: %v", err)
+				}
+			}
+
+			// Give the sampling loop a chance to notice a limit
+			time.Sleep(50 * time.Millisecond)
+
+			if !s.running() {
+				t.Errorf("dumps stopped the logger at its limit of %s", s.limit)
+			}
+		})
+	}
+}
+
+// TestTempPathLeak starts and stops loggers without a path, as Handler does, checking that no files are left open.
+func TestTempPathLeak(t *testing.T) {
+	t.Setenv("TMPDIR", t.TempDir())
+
+	fds := func() int {
+		des, err := os.ReadDir("/proc/self/fd")
+		if err != nil {
+			t.Skipf("can't count open files: %v", err)
+		}
+
+		return len(des)
+	}
+
+	before := fds()
+
+	for i := 0; i < 10; i++ {
+		s, err := Start(Config{Poll: time.Hour, Quiet: true})
+		if err != nil {
+			t.Fatalf("start: %v", err)
+		}
+
+		if err := s.Stop(); err != nil {
+			t.Fatalf("stop: %v", err)
+		}
+	}
+
+	if after := fds(); after > before {
+		t.Errorf("%d files open after 10 loggers were started and stopped, %d before", after, before)
+	}
+}
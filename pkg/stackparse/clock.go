@@ -0,0 +1,155 @@
+/*
+Copyright 2020 Google LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package stackparse
+
+import (
+	"fmt"
+	"sort"
+	"time"
+)
+
+const (
+	// clockSkew is how far the wall clock may drift from the monotonic clock between samples before it is flagged.
+	clockSkew = 250 * time.Millisecond
+	// minGap is the shortest stretch without samples that is flagged as a gap.
+	minGap = time.Second
+	// gapFactor is how many typical sample intervals must pass without a sample before it is flagged as a gap.
+	gapFactor = 10
+)
+
+// Gap is a discontinuity in a timeline, such as a wall clock jump or a stretch without samples.
+type Gap struct {
+	StartDelta time.Duration
+	EndDelta   time.Duration
+	Reason     string
+}
+
+// clamper fills in the wall clock time of samples which lack one, and keeps sample times from running backwards, as
+// they may in logs without a monotonic clock. Later samples are shifted along with a backwards jump, so that the
+// intervals between them are kept.
+type clamper struct {
+	prev  time.Time
+	shift time.Duration
+}
+
+// clamp adjusts the time of the next sample.
+func (c *clamper) clamp(s *StackSample) {
+	if s.Wall.IsZero() {
+		s.Wall = s.Time
+	}
+
+	s.Time = s.Time.Add(c.shift)
+
+	if !c.prev.IsZero() && s.Time.Before(c.prev) {
+		c.shift += c.prev.Sub(s.Time)
+		s.Time = c.prev
+	}
+
+	c.prev = s.Time
+}
+
+// gapFinder flags wall clock jumps and unusually long intervals between consecutive samples, one sample at a time.
+type gapFinder struct {
+	start    time.Time
+	prevTime time.Time
+	prevWall time.Time
+	// intervals are the times between consecutive samples, from which the typical interval is found
+	intervals []time.Duration
+	gaps      []*Gap
+	// long are stretches without samples which are gaps if they are much longer than the typical interval
+	long []*Gap
+	// slowest is the longest interval the sampler was configured to wait between samples, if known
+	slowest time.Duration
+}
+
+// add checks the interval between a sample and the one before it.
+func (f *gapFinder) add(s *StackSample) {
+	prevTime, prevWall := f.prevTime, f.prevWall
+	f.prevTime, f.prevWall = s.Time, s.Wall
+
+	if prevTime.IsZero() {
+		return
+	}
+
+	elapsed := s.Time.Sub(prevTime)
+	wall := s.Wall.Sub(prevWall)
+	f.intervals = append(f.intervals, elapsed)
+
+	g := &Gap{StartDelta: prevTime.Sub(f.start), EndDelta: s.Time.Sub(f.start)}
+
+	switch {
+	case wall < 0:
+		g.Reason = fmt.Sprintf("wall clock went back %s", -wall)
+	case wall-elapsed > clockSkew:
+		g.Reason = fmt.Sprintf("wall clock jumped forward %s, or the process was suspended", wall-elapsed)
+	case elapsed-wall > clockSkew:
+		g.Reason = fmt.Sprintf("wall clock went back %s", elapsed-wall)
+	case elapsed > minGap:
+		g.Reason = fmt.Sprintf("no samples for %s", elapsed)
+		f.long = append(f.long, g)
+
+		return
+	default:
+		return
+	}
+
+	f.gaps = append(f.gaps, g)
+}
+
+// result returns the gaps found, in order.
+func (f *gapFinder) result() []*Gap {
+	typical := medianInterval(f.intervals)
+	gaps := append([]*Gap{}, f.gaps...)
+
+	// An adaptive sampler backs off while stacks are static, so intervals up to its slowest are expected, however
+	// quickly it sampled otherwise
+	for _, g := range f.long {
+		if d := g.EndDelta - g.StartDelta; d > gapFactor*typical && d > 2*f.slowest {
+			gaps = append(gaps, g)
+		}
+	}
+
+	sort.SliceStable(gaps, func(i, j int) bool { return gaps[i].StartDelta < gaps[j].StartDelta })
+
+	return gaps
+}
+
+// slowestPoll returns the longest interval a sampler described by md waits between samples, including jitter.
+func slowestPoll(md *Metadata) time.Duration {
+	if md == nil {
+		return 0
+	}
+
+	d := md.Poll
+	if md.MaxPoll > d {
+		d = md.MaxPoll
+	}
+
+	return time.Duration(float64(d) * (1 + md.Jitter))
+}
+
+// medianInterval returns the typical time between consecutive samples.
+func medianInterval(intervals []time.Duration) time.Duration {
+	if len(intervals) == 0 {
+		return 0
+	}
+
+	ds := append([]time.Duration{}, intervals...)
+	sort.Slice(ds, func(i, j int) bool { return ds[i] < ds[j] })
+
+	return ds[len(ds)/2]
+}
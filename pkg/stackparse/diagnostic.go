@@ -0,0 +1,123 @@
+/*
+Copyright 2020 Google LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package stackparse
+
+import (
+	"errors"
+	"fmt"
+)
+
+// errTruncated reports a sample which was cut short, typically because the recording process was killed.
+var errTruncated = errors.New("truncated sample")
+
+// Diagnostic is a problem found in a stack log. When a reader is tolerant, problems are recorded as diagnostics and
+// skipped; otherwise the first is returned as an error.
+type Diagnostic struct {
+	// Path is the file the problem was found in, when read by OpenFile.
+	Path string
+	// Line is the line number the problem was found at, counting from 1.
+	Line int
+	// Offset is the byte offset of that line within the uncompressed log.
+	Offset int64
+	// Reason describes the problem.
+	Reason string
+
+	err error
+}
+
+// Error describes the problem and where it was found.
+func (d *Diagnostic) Error() string {
+	s := fmt.Sprintf("line %d (offset %d): %s", d.Line, d.Offset, d.Reason)
+	if d.Path != "" {
+		s = fmt.Sprintf("%s: %s", d.Path, s)
+	}
+
+	return s
+}
+
+// Unwrap returns the underlying error.
+func (d *Diagnostic) Unwrap() error {
+	return d.err
+}
+
+// SetTolerant makes the reader skip bad records, recover a trailing sample which was cut short, and treat a
+// truncated compressed stream as the end of the log, recording each problem as a diagnostic rather than failing. It
+// must be called before the first sample is read.
+func (r *Reader) SetTolerant(tolerant bool) {
+	r.tolerant = tolerant
+}
+
+// Diagnostics returns the problems skipped so far by a tolerant reader.
+func (r *Reader) Diagnostics() []*Diagnostic {
+	return r.diags
+}
+
+// problem handles a problem with the current line. A tolerant reader records it and returns nil, so that the line is
+// skipped; otherwise it is returned.
+func (r *Reader) problem(err error) error {
+	return r.problemAt(r.n, r.offset, err)
+}
+
+// problemAt handles a problem found at a line and offset.
+func (r *Reader) problemAt(line int, offset int64, err error) error {
+	d := &Diagnostic{Path: r.name, Line: line, Offset: offset, Reason: err.Error(), err: err}
+
+	if !r.tolerant {
+		return d
+	}
+
+	r.diags = append(r.diags, d)
+
+	return nil
+}
+
+// truncated handles a final sample which was cut short. A tolerant reader records it and returns nil, so that the
+// sample is recovered; otherwise it is returned, rather than silently dropping the sample.
+func (r *Reader) truncated(line int, offset int64) error {
+	if r.tolerant {
+		return r.problemAt(line, offset, fmt.Errorf("%w recovered", errTruncated))
+	}
+
+	return r.problemAt(line, offset, errTruncated)
+}
+
+// scan reads the next line, keeping track of its line number and offset.
+func (r *Reader) scan() bool {
+	if !r.lines.Scan() {
+		return false
+	}
+
+	r.offset = r.next
+	r.n++
+	r.next += int64(len(r.lines.Bytes())) + 1
+
+	return true
+}
+
+// scanErr returns the error which ended reading, if any. A tolerant reader treats a truncated or unreadable stream
+// as its end.
+func (r *Reader) scanErr() error {
+	err := r.lines.Err()
+	if err == nil || r.ended {
+		return nil
+	}
+
+	// A tolerant reader may return to the end of the stream for samples it still holds
+	r.ended = true
+
+	return r.problemAt(r.n+1, r.next, fmt.Errorf("unreadable: %w", err))
+}
@@ -0,0 +1,186 @@
+/*
+Copyright 2020 Google LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package stackparse
+
+import (
+	"bytes"
+	"errors"
+	"strings"
+	"testing"
+)
+
+// v1Log has two complete samples, followed by a third which was cut short.
+const v1Log = `1000000000
+goroutine 1 [running]:
+main.main()
+	/app/main.go:10 +0x1d
+
+-
+2000000000
+goroutine 1 [sleep]:
+main.main()
+	/app/main.go:11 +0x1d
+
+-
+3000000000
+goroutine 1 [chan receive]:
+main.main()
+	/app/main.go:12 +0x1d
+`
+
+// v2Log has two complete samples, followed by a third which was cut short.
+const v2Log = `slowjam v2
+T 1000000000
+F 1 "main.main()\n\t/app/main.go:10 +0x1d"
+G 1 1 "goroutine 1 [running]:"
+-
+O 1000 500
+T 2000000000
+G 1 1 "goroutine 1 [sleep]:"
+-
+T 3000000000
+G 1 1 "goroutine 1 [chan receive]:"
+`
+
+// complete returns a log without its final, truncated sample.
+func complete(log string, terminator string) string {
+	return log[:strings.LastIndex(log, terminator)+len(terminator)]
+}
+
+// parse reads every sample of a log, returning them along with the diagnostics of a tolerant reader.
+func parse(t *testing.T, log string, tolerant bool) ([]*StackSample, []*Diagnostic, error) {
+	t.Helper()
+
+	r, err := NewReader(strings.NewReader(log))
+	if err != nil {
+		t.Fatalf("NewReader: %v", err)
+	}
+	defer r.Close()
+
+	r.SetTolerant(tolerant)
+	l, err := readAll(r)
+
+	return l.Samples, r.Diagnostics(), err
+}
+
+func TestDiagnostics(t *testing.T) {
+	tests := []struct {
+		name string
+		log  string
+		// samples and diags are what a tolerant reader recovers and reports
+		samples int
+		diags   int
+		// line is where a strict reader fails, or 0 if it succeeds
+		line   int
+		reason string
+	}{
+		{name: "v1 complete", log: complete(v1Log, "-\n"), samples: 2},
+		{name: "v2 complete", log: complete(v2Log, "-\n"), samples: 2},
+		{name: "v1 truncated", log: v1Log, samples: 3, diags: 1, line: 16, reason: "truncated sample"},
+		{name: "v2 truncated", log: v2Log, samples: 3, diags: 1, line: 11, reason: "truncated sample"},
+		{
+			name:    "v1 garbage",
+			log:     strings.Replace(complete(v1Log, "-\n"), "-\n2000000000", "-\ngarbage\n2000000000", 1),
+			samples: 2,
+			diags:   1,
+			line:    7,
+			reason:  "timestamp",
+		},
+		{
+			name:    "v2 garbage",
+			log:     strings.Replace(complete(v2Log, "-\n"), "O 1000 500\n", "O 1000 500\nZ garbage\n", 1),
+			samples: 2,
+			diags:   1,
+			line:    7,
+			reason:  "unknown record type",
+		},
+		{
+			name:    "v2 corrupt frame",
+			log:     strings.Replace(complete(v2Log, "-\n"), `F 1 "main`, `F 1 main`, 1),
+			samples: 2,
+			diags:   3,
+			line:    3,
+			reason:  "frame text",
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			samples, _, err := parse(t, tc.log, false)
+
+			if tc.line == 0 {
+				if err != nil {
+					t.Fatalf("strict read: %v", err)
+				}
+
+				if len(samples) != tc.samples {
+					t.Fatalf("strict read got %d samples, want %d", len(samples), tc.samples)
+				}
+
+				return
+			}
+
+			var d *Diagnostic
+			if !errors.As(err, &d) {
+				t.Fatalf("strict read error = %v, want a diagnostic", err)
+			}
+
+			if d.Line != tc.line || !strings.Contains(d.Reason, tc.reason) {
+				t.Errorf("strict read error = %v, want line %d: %s", d, tc.line, tc.reason)
+			}
+
+			samples, diags, err := parse(t, tc.log, true)
+			if err != nil {
+				t.Fatalf("tolerant read: %v", err)
+			}
+
+			if len(samples) != tc.samples || len(diags) != tc.diags {
+				t.Errorf("tolerant read got %d samples and %d diagnostics %v, want %d and %d", len(samples), len(diags), diags, tc.samples, tc.diags)
+			}
+		})
+	}
+}
+
+// TestTruncatedRecovery checks that the goroutines of a truncated sample are recovered.
+func TestTruncatedRecovery(t *testing.T) {
+	for name, log := range map[string]string{"v1": v1Log, "v2": v2Log} {
+		t.Run(name, func(t *testing.T) {
+			samples, diags, err := parse(t, log, true)
+			if err != nil {
+				t.Fatalf("tolerant read: %v", err)
+			}
+
+			if len(diags) != 1 || !errors.Is(diags[0], errTruncated) {
+				t.Fatalf("diagnostics = %v, want a truncated sample", diags)
+			}
+
+			last := samples[len(samples)-1]
+			if len(last.Context.Goroutines) != 1 || last.Context.Goroutines[0].State != "chan receive" {
+				t.Errorf("truncated sample has goroutines %+v, want one in chan receive", last.Context.Goroutines)
+			}
+
+			var b bytes.Buffer
+			for _, s := range samples {
+				b.WriteString(s.Time.UTC().Format("15:04:05 "))
+			}
+
+			if got := b.String(); got != "00:00:01 00:00:02 00:00:03 " {
+				t.Errorf("sample times = %q, want 1s, 2s and 3s after the epoch", got)
+			}
+		})
+	}
+}
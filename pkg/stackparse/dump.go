@@ -0,0 +1,208 @@
+/*
+Copyright 2020 Google LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package stackparse
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"regexp"
+	"runtime"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// stampFormats are the timestamp formats recognized between goroutine dumps, such as the output of date.
+var stampFormats = []string{
+	time.RFC3339Nano,
+	time.UnixDate,
+	time.RFC1123,
+	time.RFC1123Z,
+	time.ANSIC,
+	"2006-01-02 15:04:05.999999999",
+	"2006-01-02 15:04:05 MST",
+	"20060102T150405",
+}
+
+var (
+	// unixStamp matches a Unix time in seconds, milliseconds, microseconds or nanoseconds
+	unixStamp = regexp.MustCompile(`^\d{10}(\d{3}){0,3}$`)
+	// nameStamp matches a timestamp within a file name, such as goroutine-20261017T045125.txt or 1792212470.txt
+	nameStamp = regexp.MustCompile(`\d{8}T\d{6}|\d{10}(\d{3}){0,3}`)
+)
+
+// OpenDumps returns a reader for goroutine dumps in the text format of runtime.Stack and
+// /debug/pprof/goroutine?debug=2, so that processes which were not built with stacklog can be analyzed. The path may
+// be a directory with a dump per file, or a file of dumps, each preceded by a line with its timestamp, such as the
+// output of:
+//
+//	while sleep 1; do date; curl -s localhost:6060/debug/pprof/goroutine?debug=2; done
+//
+// Dumps without a timestamp of their own are timed by the file name, such as goroutine-1792212470.txt, or else by the
+// modification time of the file.
+func OpenDumps(path string) (*Reader, error) {
+	paths := []string{path}
+
+	fi, err := os.Stat(path)
+	if err != nil {
+		return nil, err
+	}
+
+	if fi.IsDir() {
+		paths, err = dumpFiles(path)
+		if err != nil {
+			return nil, err
+		}
+
+		if len(paths) == 0 {
+			return nil, fmt.Errorf("%s: no goroutine dumps found", path)
+		}
+	}
+
+	sr := &Reader{paths: paths, dumps: true, workers: runtime.GOMAXPROCS(0)}
+
+	if err := sr.openNext(); err != nil {
+		return nil, err
+	}
+
+	return sr, nil
+}
+
+// ReadDumps parses goroutine dumps, as described by OpenDumps.
+func ReadDumps(path string) (*Log, error) {
+	r, err := OpenDumps(path)
+	if err != nil {
+		return &Log{Samples: []*StackSample{}}, err
+	}
+	defer r.Close()
+
+	return readAll(r)
+}
+
+// dumpFiles returns the files of a directory of goroutine dumps, ordered by time.
+func dumpFiles(dir string) ([]string, error) {
+	des, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	paths := []string{}
+	times := map[string]time.Time{}
+
+	for _, de := range des {
+		if !de.Type().IsRegular() || strings.HasPrefix(de.Name(), ".") {
+			continue
+		}
+
+		p := filepath.Join(dir, de.Name())
+
+		fi, err := de.Info()
+		if err != nil {
+			return nil, err
+		}
+
+		paths = append(paths, p)
+		times[p] = fileStamp(p, fi.ModTime())
+	}
+
+	sort.SliceStable(paths, func(i, j int) bool {
+		if !times[paths[i]].Equal(times[paths[j]]) {
+			return times[paths[i]].Before(times[paths[j]])
+		}
+
+		return paths[i] < paths[j]
+	})
+
+	return paths, nil
+}
+
+// fileStamp returns the time of a goroutine dump from its file name, falling back to its modification time.
+func fileStamp(path string, mtime time.Time) time.Time {
+	if m := nameStamp.FindString(filepath.Base(path)); m != "" {
+		if t, ok := parseStamp(m); ok {
+			return t
+		}
+	}
+
+	return mtime
+}
+
+// parseStamp parses a line which separates goroutine dumps, returning false if it is not a timestamp.
+func parseStamp(line string) (time.Time, bool) {
+	line = strings.TrimSpace(line)
+
+	if unixStamp.MatchString(line) {
+		n, err := strconv.ParseInt(line, 10, 64)
+		if err != nil {
+			return time.Time{}, false
+		}
+
+		// Scale seconds, milliseconds and microseconds up to nanoseconds
+		for i := len(line); i < 19; i += 3 {
+			n *= 1000
+		}
+
+		return time.Unix(0, n), true
+	}
+
+	for _, f := range stampFormats {
+		if t, err := time.Parse(f, line); err == nil {
+			return t, true
+		}
+	}
+
+	return time.Time{}, false
+}
+
+// nextDump parses the next goroutine dump. A timestamp line ends the dump before it, and times the one after it.
+func (r *Reader) nextDump() (*StackSample, error) {
+	sd := bytes.NewBuffer([]byte{})
+	t := r.stamp
+
+	for r.scan() {
+		if ts, ok := parseStamp(r.lines.Text()); ok {
+			r.stamp = ts
+
+			if bytes.Contains(sd.Bytes(), []byte("goroutine ")) {
+				return &StackSample{Time: t, raw: sd.Bytes(), line: r.n, offset: r.offset}, nil
+			}
+
+			// Nothing but a timestamp has been seen yet
+			sd.Reset()
+			t = ts
+
+			continue
+		}
+
+		sd.Write(r.lines.Bytes())
+		sd.Write([]byte{'\n'})
+	}
+
+	if err := r.scanErr(); err != nil {
+		return nil, err
+	}
+
+	if !bytes.Contains(sd.Bytes(), []byte("goroutine ")) {
+		return nil, io.EOF
+	}
+
+	return &StackSample{Time: t, raw: sd.Bytes(), line: r.n, offset: r.offset}, nil
+}
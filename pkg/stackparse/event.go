@@ -0,0 +1,103 @@
+/*
+Copyright 2020 Google LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package stackparse
+
+import (
+	"sort"
+	"time"
+)
+
+// EventKind is the type of an annotation recorded by the program under observation.
+type EventKind string
+
+const (
+	// EventMark is an instantaneous event.
+	EventMark EventKind = "mark"
+	// EventBegin starts a named phase.
+	EventBegin EventKind = "begin"
+	// EventEnd ends a named phase.
+	EventEnd EventKind = "end"
+)
+
+// Event is an annotation recorded by the program under observation, such as the start of a phase.
+type Event struct {
+	Time time.Time
+	Kind EventKind
+	Name string
+}
+
+// Marker is an annotation placed on a timeline: either an instant, or a phase from Begin to End.
+type Marker struct {
+	Name       string
+	StartDelta time.Duration
+	EndDelta   time.Duration
+}
+
+// Instant returns true if the marker is a single point in time rather than a phase.
+func (m *Marker) Instant() bool {
+	return m.StartDelta == m.EndDelta
+}
+
+// createMarkers pairs up events, in the order they were recorded, into markers.
+func createMarkers(events []*Event, start time.Time, end time.Time) []*Marker {
+	delta := func(t time.Time) time.Duration {
+		if t.Before(start) {
+			return 0
+		}
+
+		if t.After(end) {
+			return end.Sub(start)
+		}
+
+		return t.Sub(start)
+	}
+
+	markers := []*Marker{}
+	open := map[string][]*Marker{}
+
+	for _, e := range events {
+		switch e.Kind {
+		case EventMark:
+			markers = append(markers, &Marker{Name: e.Name, StartDelta: delta(e.Time), EndDelta: delta(e.Time)})
+		case EventBegin:
+			m := &Marker{Name: e.Name, StartDelta: delta(e.Time), EndDelta: -1}
+			markers = append(markers, m)
+			open[e.Name] = append(open[e.Name], m)
+		case EventEnd:
+			ms := open[e.Name]
+			if len(ms) == 0 {
+				// The beginning was not recorded, for instance if it was evicted from a flight recorder
+				markers = append(markers, &Marker{Name: e.Name, StartDelta: 0, EndDelta: delta(e.Time)})
+				continue
+			}
+
+			ms[len(ms)-1].EndDelta = delta(e.Time)
+			open[e.Name] = ms[:len(ms)-1]
+		}
+	}
+
+	// Phases which never ended last until the end of the timeline
+	for _, m := range markers {
+		if m.EndDelta < 0 {
+			m.EndDelta = end.Sub(start)
+		}
+	}
+
+	sort.SliceStable(markers, func(i, j int) bool { return markers[i].StartDelta < markers[j].StartDelta })
+
+	return markers
+}
@@ -0,0 +1,110 @@
+/*
+Copyright 2020 Google LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package stackparse
+
+import (
+	"bytes"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/google/slowjam/internal/logformat"
+)
+
+// Labels are the runtime/pprof labels attached to a goroutine.
+type Labels map[string]string
+
+// String returns the labels as sorted key=value pairs.
+func (l Labels) String() string {
+	keys := []string{}
+	for k := range l {
+		keys = append(keys, k)
+	}
+
+	sort.Strings(keys)
+
+	kvs := []string{}
+	for _, k := range keys {
+		kvs = append(kvs, fmt.Sprintf("%s=%s", k, l[k]))
+	}
+
+	return strings.Join(kvs, ",")
+}
+
+// Matches returns true if every label in want has the same value in l.
+func (l Labels) Matches(want map[string]string) bool {
+	for k, v := range want {
+		if l[k] != v {
+			return false
+		}
+	}
+
+	return true
+}
+
+// extractLabels finds the labels of each goroutine in runtime.Stack output, such as:
+//
+//	goroutine 7 [select] {request: 42, tenant: "a b"}:
+//
+// It returns the labels by goroutine ID, and the output with labels removed, as they confuse the stack parser.
+func extractLabels(stacks []byte) (map[int]Labels, []byte) {
+	if !bytes.Contains(stacks, []byte("] {")) {
+		return nil, stacks
+	}
+
+	found := map[int]Labels{}
+	out := make([]byte, 0, len(stacks))
+
+	for _, line := range bytes.SplitAfter(stacks, []byte("\n")) {
+		if !bytes.HasPrefix(line, []byte("goroutine ")) {
+			out = append(out, line...)
+			continue
+		}
+
+		text := strings.TrimRight(string(line), "\n")
+
+		id, labels, ok := parseGoroutineLabels(text)
+		if !ok {
+			out = append(out, line...)
+			continue
+		}
+
+		found[id] = labels
+		out = append(out, text[:strings.Index(text, "] {")+1]...)
+		out = append(out, ":\n"...)
+	}
+
+	return found, out
+}
+
+// parseGoroutineLabels parses the labels from a goroutine header line, if it has any.
+func parseGoroutineLabels(line string) (int, Labels, bool) {
+	fields := strings.Fields(line)
+	if len(fields) < 2 {
+		return 0, nil, false
+	}
+
+	id, err := strconv.Atoi(fields[1])
+	if err != nil {
+		return 0, nil, false
+	}
+
+	labels := logformat.HeaderLabels(line)
+
+	return id, labels, len(labels) > 0
+}
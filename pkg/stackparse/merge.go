@@ -0,0 +1,137 @@
+/*
+Copyright 2020 Google LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package stackparse
+
+import (
+	"fmt"
+	"path/filepath"
+	"sort"
+	"time"
+)
+
+// Process is the timeline of one of several processes merged into a single timeline.
+type Process struct {
+	// Name identifies the process, such as "minikube (pid 42)".
+	Name string
+	// Offset is how long after the start of the merged timeline the first sample of the process was taken.
+	Offset time.Duration
+	// Duration is the time between the first and last samples of the process.
+	Duration time.Duration
+	Timeline *Timeline
+}
+
+// ProcessName returns a name for the process which recorded a log, or the source its stacks were fetched from,
+// falling back to the name of the log file.
+func ProcessName(path string, md *Metadata) string {
+	if md == nil || md.PID == 0 {
+		return filepath.Base(path)
+	}
+
+	if md.Source != "" {
+		return md.Source
+	}
+
+	if len(md.Args) == 0 {
+		return fmt.Sprintf("pid %d", md.PID)
+	}
+
+	return fmt.Sprintf("%s (pid %d)", filepath.Base(md.Args[0]), md.PID)
+}
+
+// MergeTimelines combines the timelines of several processes, such as a parent and its children, into one. The
+// timelines are aligned on the wall clock time of their first samples, and are modified in place so that their
+// offsets are relative to the start of the merged timeline. Processes are ordered by when they were first sampled.
+func MergeTimelines(ps []*Process) *Timeline {
+	tl := &Timeline{Goroutines: map[int]*GoroutineTimeline{}, Processes: ps}
+
+	for _, p := range ps {
+		if tl.Start.IsZero() || p.Timeline.Start.Before(tl.Start) {
+			tl.Start = p.Timeline.Start
+		}
+
+		if p.Timeline.End.After(tl.End) {
+			tl.End = p.Timeline.End
+		}
+
+		tl.Samples += p.Timeline.Samples
+		tl.Overhead += p.Timeline.Overhead
+	}
+
+	for _, p := range ps {
+		p.Offset = p.Timeline.Start.Sub(tl.Start)
+		p.Duration = p.Timeline.End.Sub(p.Timeline.Start)
+		shiftTimeline(p.Timeline, p.Offset)
+		p.Timeline.Start = tl.Start
+		p.Timeline.End = tl.End
+	}
+
+	sort.SliceStable(ps, func(i, j int) bool { return ps[i].Offset < ps[j].Offset })
+
+	return tl
+}
+
+// Procs returns the processes of a timeline: those merged into it, or else the timeline itself as a single unnamed
+// process.
+func (tl *Timeline) Procs() []*Process {
+	if len(tl.Processes) > 0 {
+		return tl.Processes
+	}
+
+	return []*Process{{Timeline: tl}}
+}
+
+// shiftTimeline moves every offset in a timeline later by d.
+func shiftTimeline(tl *Timeline, d time.Duration) {
+	if d == 0 {
+		return
+	}
+
+	for _, g := range tl.Goroutines {
+		for _, l := range g.Layers {
+			for _, c := range l.Calls {
+				c.StartDelta += d
+				c.EndDelta += d
+			}
+		}
+	}
+
+	for _, m := range tl.Markers {
+		m.StartDelta += d
+		m.EndDelta += d
+	}
+
+	for _, ps := range tl.Metrics {
+		for i := range ps {
+			ps[i].Delta += d
+		}
+	}
+
+	for _, p := range tl.Pauses {
+		p.StartDelta += d
+		p.EndDelta += d
+	}
+
+	for _, f := range tl.Fetches {
+		f.StartDelta += d
+		f.EndDelta += d
+	}
+
+	for _, g := range tl.Gaps {
+		g.StartDelta += d
+		g.EndDelta += d
+	}
+}
@@ -0,0 +1,110 @@
+/*
+Copyright 2020 Google LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package stackparse
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+// Metadata describes the process that recorded a stack log.
+type Metadata struct {
+	Start   time.Time     `json:"start"`
+	Poll    time.Duration `json:"poll"`
+	MinPoll time.Duration `json:"min_poll,omitempty"`
+	MaxPoll time.Duration `json:"max_poll,omitempty"`
+	Jitter  float64       `json:"jitter,omitempty"`
+	// Source describes where stacks were fetched from, if they are not those of the recording process.
+	Source     string    `json:"source,omitempty"`
+	Args       []string  `json:"args,omitempty"`
+	PID        int       `json:"pid"`
+	ParentPID  int       `json:"ppid,omitempty"`
+	Hostname   string    `json:"hostname,omitempty"`
+	GOMAXPROCS int       `json:"gomaxprocs"`
+	GoVersion  string    `json:"go_version"`
+	GOOS       string    `json:"goos"`
+	GOARCH     string    `json:"goarch"`
+	Main       *Module   `json:"main,omitempty"`
+	Modules    []*Module `json:"modules,omitempty"`
+}
+
+// Module is a Go module compiled into the recorded binary.
+type Module struct {
+	Path    string `json:"path"`
+	Version string `json:"version,omitempty"`
+}
+
+// Command returns the command-line of the recorded process.
+func (m *Metadata) Command() string {
+	if m == nil {
+		return ""
+	}
+
+	return strings.Join(m.Args, " ")
+}
+
+// Describe returns human-readable lines summarizing the recorded process.
+func (m *Metadata) Describe() []string {
+	if m == nil {
+		return nil
+	}
+
+	lines := []string{}
+
+	if m.Source != "" {
+		lines = append(lines, fmt.Sprintf("stacks from %s, recorded by:", m.Source))
+	}
+
+	if len(m.Args) > 0 {
+		lines = append(lines, fmt.Sprintf("command: %s", m.Command()))
+	}
+
+	lines = append(lines,
+		fmt.Sprintf("pid %d%s on %s, started %s", m.PID, m.parent(), m.Hostname, m.Start.Format(time.RFC3339)),
+		fmt.Sprintf("%s %s/%s, GOMAXPROCS=%d, sampled every %s", m.GoVersion, m.GOOS, m.GOARCH, m.GOMAXPROCS, m.pollInterval()),
+	)
+
+	if m.Main != nil && m.Main.Path != "" {
+		lines = append(lines, fmt.Sprintf("main module: %s %s", m.Main.Path, m.Main.Version))
+	}
+
+	return lines
+}
+
+// parent describes the parent process, if known.
+func (m *Metadata) parent() string {
+	if m.ParentPID == 0 {
+		return ""
+	}
+
+	return fmt.Sprintf(" (parent %d)", m.ParentPID)
+}
+
+// pollInterval describes how often samples were taken.
+func (m *Metadata) pollInterval() string {
+	s := m.Poll.String()
+	if m.MaxPoll > 0 {
+		s = fmt.Sprintf("%s-%s adaptively", m.MinPoll, m.MaxPoll)
+	}
+
+	if m.Jitter > 0 {
+		s = fmt.Sprintf("%s ±%.0f%%", s, m.Jitter*100)
+	}
+
+	return s
+}
@@ -0,0 +1,79 @@
+/*
+Copyright 2020 Google LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package stackparse
+
+// scanJob is a sample whose goroutines are being parsed by a worker.
+type scanJob struct {
+	s    *StackSample
+	done chan error
+}
+
+// nextParallel returns the next sample, reading ahead so that the goroutines of several samples are parsed at once.
+// Reading the log is cheap compared to parsing goroutines, so it remains serial.
+func (r *Reader) nextParallel() (*StackSample, error) {
+	if r.jobs == nil {
+		r.startWorkers()
+	}
+
+	for {
+		for len(r.queue) < 2*r.workers && r.rawErr == nil {
+			s, err := r.nextRaw()
+			if err != nil {
+				r.rawErr = err
+				break
+			}
+
+			j := &scanJob{s: s, done: make(chan error, 1)}
+			r.jobs <- j
+			r.queue = append(r.queue, j)
+		}
+
+		if len(r.queue) == 0 {
+			return nil, r.rawErr
+		}
+
+		j := r.queue[0]
+		r.queue = r.queue[1:]
+
+		// A tolerant reader skips samples which could not be parsed
+		if err := r.scanned(j.s, <-j.done); err != nil || j.s.Context != nil {
+			return j.s, err
+		}
+	}
+}
+
+// startWorkers starts the goroutines which parse samples.
+func (r *Reader) startWorkers() {
+	jobs := make(chan *scanJob, 2*r.workers)
+	r.jobs = jobs
+
+	for i := 0; i < r.workers; i++ {
+		go func() {
+			for j := range jobs {
+				j.done <- j.s.scan()
+			}
+		}()
+	}
+}
+
+// stopWorkers stops the goroutines which parse samples, once they have finished the samples queued.
+func (r *Reader) stopWorkers() {
+	if r.jobs != nil {
+		close(r.jobs)
+		r.jobs = nil
+	}
+}
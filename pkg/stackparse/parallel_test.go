@@ -0,0 +1,170 @@
+/*
+Copyright 2020 Google LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package stackparse
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"testing"
+	"time"
+)
+
+// minikubeSamples and minikubeGoroutines approximate the size of the stack log behind example/minikube.html.
+const (
+	minikubeSamples    = 230
+	minikubeGoroutines = 40
+)
+
+// generateLog returns a v1 stack log of samples taken every 125ms, each with the given number of goroutines. Stacks
+// vary between samples, as they would while a program runs.
+func generateLog(samples int, goroutines int) []byte {
+	var b bytes.Buffer
+
+	start := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+
+	for i := 0; i < samples; i++ {
+		fmt.Fprintf(&b, "%d\n", start.Add(time.Duration(i)*125*time.Millisecond).UnixNano())
+
+		for g := 1; g <= goroutines; g++ {
+			fmt.Fprintf(&b, "goroutine %d [chan receive]:\n", g)
+
+			for d := 0; d < 2+(g+i)%8; d++ {
+				fmt.Fprintf(&b, "example.com/pkg%d.fn%d(0x%x, 0x%x)\n", d%3, d, g, i)
+				fmt.Fprintf(&b, "\t/src/example.com/pkg%d/file%d.go:%d +0x%x\n", d%3, d, 10+(i+d)%50, 0x1d+d)
+			}
+
+			if g > 1 {
+				b.WriteString("created by example.com/pkg0.start in goroutine 1\n")
+				b.WriteString("\t/src/example.com/pkg0/start.go:42 +0x5e\n")
+			}
+
+			b.WriteString("\n")
+		}
+
+		b.WriteString("-\n")
+	}
+
+	return b.Bytes()
+}
+
+// readLog reads every sample of a stack log using the given number of workers.
+func readLog(t testing.TB, log []byte, workers int) []*StackSample {
+	r, err := NewReader(bytes.NewReader(log))
+	if err != nil {
+		t.Fatalf("NewReader: %v", err)
+	}
+	defer r.Close()
+
+	r.SetWorkers(workers)
+
+	samples := []*StackSample{}
+
+	for {
+		s, err := r.Next()
+		if err == io.EOF {
+			return samples
+		}
+
+		if err != nil {
+			t.Fatalf("Next: %v", err)
+		}
+
+		samples = append(samples, s)
+	}
+}
+
+func TestReadParallelPreservesOrder(t *testing.T) {
+	log := generateLog(minikubeSamples, minikubeGoroutines)
+	serial := readLog(t, log, 1)
+	parallel := readLog(t, log, 8)
+
+	if len(serial) != minikubeSamples || len(parallel) != minikubeSamples {
+		t.Fatalf("got %d serial and %d parallel samples, want %d", len(serial), len(parallel), minikubeSamples)
+	}
+
+	for i := range serial {
+		s, p := serial[i], parallel[i]
+
+		if !s.Time.Equal(p.Time) {
+			t.Fatalf("sample %d: parallel time %s, serial time %s", i, p.Time, s.Time)
+		}
+
+		if len(s.Context.Goroutines) != len(p.Context.Goroutines) {
+			t.Fatalf("sample %d: %d parallel goroutines, %d serial", i, len(p.Context.Goroutines), len(s.Context.Goroutines))
+		}
+
+		for j, g := range s.Context.Goroutines {
+			pg := p.Context.Goroutines[j]
+			if g.ID != pg.ID || g.Stack.Calls[0].Line != pg.Stack.Calls[0].Line {
+				t.Fatalf("sample %d goroutine %d: parallel %d at line %d, serial %d at line %d", i, j, pg.ID, pg.Stack.Calls[0].Line, g.ID, g.Stack.Calls[0].Line)
+			}
+		}
+	}
+}
+
+func BenchmarkRead(b *testing.B) {
+	sizes := []struct {
+		name    string
+		samples int
+	}{
+		{"minikube", minikubeSamples},
+		{"100x", 100 * minikubeSamples},
+	}
+
+	for _, size := range sizes {
+		log := generateLog(size.samples, minikubeGoroutines)
+
+		for _, w := range []struct {
+			name    string
+			workers int
+		}{
+			{"serial", 1},
+			{"parallel", 0},
+		} {
+			b.Run(fmt.Sprintf("%s/%s", size.name, w.name), func(b *testing.B) {
+				b.SetBytes(int64(len(log)))
+
+				for i := 0; i < b.N; i++ {
+					r, err := NewReader(bytes.NewReader(log))
+					if err != nil {
+						b.Fatalf("NewReader: %v", err)
+					}
+
+					if w.workers > 0 {
+						r.SetWorkers(w.workers)
+					}
+
+					n := 0
+					for _, err := range r.All() {
+						if err != nil {
+							b.Fatalf("Next: %v", err)
+						}
+
+						n++
+					}
+
+					r.Close()
+
+					if n != size.samples {
+						b.Fatalf("read %d samples, want %d", n, size.samples)
+					}
+				}
+			})
+		}
+	}
+}
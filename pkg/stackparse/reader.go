@@ -0,0 +1,324 @@
+/*
+Copyright 2020 Google LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package stackparse
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"iter"
+	"os"
+	"runtime"
+	"time"
+
+	"github.com/google/slowjam/internal/logformat"
+)
+
+// Reader parses a stack log one sample at a time, so that logs larger than memory may be analyzed.
+type Reader struct {
+	// paths are the rotated segments yet to be read, when reading a file
+	paths []string
+	// name is the segment being read, when reading a file
+	name  string
+	file  *os.File
+	src   io.ReadCloser
+	lines *bufio.Scanner
+	v2    bool
+	// dumps is set when reading goroutine dumps rather than a stack log, timed by stamp
+	dumps bool
+	stamp time.Time
+	err   error
+	// n is the current line number, offset is its byte offset, and next is the offset of the following line
+	n      int
+	offset int64
+	next   int64
+
+	tolerant bool
+	diags    []*Diagnostic
+	// ended is set once an error ending the stream has been recorded
+	ended bool
+	clock clamper
+
+	// workers is how many samples may be parsed at once
+	workers int
+	jobs    chan *scanJob
+	// queue are the samples being parsed, in order
+	queue []*scanJob
+	// rawErr ends reading once the samples already queued have been returned
+	rawErr error
+
+	md *Metadata
+
+	// v2 state
+	frames  map[int]string
+	gs      map[int]*v2Goroutine
+	t       time.Time
+	wall    time.Time
+	events  []*Event
+	fetches []*Fetch
+	vals    map[string]float64
+	pending *StackSample
+	// started is set once the timestamp of a sample has been read, until the sample is complete
+	started bool
+}
+
+// NewReader returns a reader for a stack log input, which may be gzip or zstd compressed. Close releases the
+// decompressor, but leaves r open.
+func NewReader(r io.Reader) (*Reader, error) {
+	sr := &Reader{workers: runtime.GOMAXPROCS(0)}
+
+	if err := sr.reset(r); err != nil {
+		return nil, err
+	}
+
+	return sr, nil
+}
+
+// OpenFile returns a reader for a stack log file, along with any rotated segments that follow it, as one continuous
+// log.
+func OpenFile(path string) (*Reader, error) {
+	sr := &Reader{paths: Segments(path), workers: runtime.GOMAXPROCS(0)}
+
+	if err := sr.openNext(); err != nil {
+		return nil, err
+	}
+
+	return sr, nil
+}
+
+// Metadata describes the recorded process, if the log format carries it. It is available once the first sample has
+// been read.
+func (r *Reader) Metadata() *Metadata {
+	return r.md
+}
+
+// Fetches returns the attempts to fetch stacks which were not followed by a sample, such as when every attempt
+// failed. It is complete once every sample has been read.
+func (r *Reader) Fetches() []*Fetch {
+	return r.fetches
+}
+
+// Next returns the next sample, or io.EOF once every sample has been read. Sample times never run backwards.
+func (r *Reader) Next() (*StackSample, error) {
+	if r.err != nil {
+		return nil, r.err
+	}
+
+	var s *StackSample
+
+	if r.workers > 1 {
+		s, r.err = r.nextParallel()
+	} else {
+		s, r.err = r.nextSerial()
+	}
+
+	if r.err != nil {
+		return nil, r.err
+	}
+
+	r.clock.clamp(s)
+
+	return s, nil
+}
+
+// SetWorkers sets how many samples may be parsed at once, which defaults to GOMAXPROCS. It must be called before the
+// first sample is read.
+func (r *Reader) SetWorkers(n int) {
+	r.workers = n
+}
+
+// nextSerial reads and parses the next sample.
+func (r *Reader) nextSerial() (*StackSample, error) {
+	for {
+		s, err := r.nextRaw()
+		if err != nil {
+			return nil, err
+		}
+
+		if err := r.scanned(s, s.scan()); err != nil || s.Context != nil {
+			return s, err
+		}
+	}
+}
+
+// scanned handles the result of parsing the goroutines of a sample. A tolerant reader skips samples which could not
+// be parsed, leaving their Context nil.
+func (r *Reader) scanned(s *StackSample, err error) error {
+	if err == nil {
+		return nil
+	}
+
+	return r.problemAt(s.line, s.offset, fmt.Errorf("goroutines: %w", err))
+}
+
+// nextRaw reads the next sample without parsing its goroutines, moving on to the next segment of a file as needed.
+func (r *Reader) nextRaw() (*StackSample, error) {
+	for {
+		var s *StackSample
+		var err error
+
+		switch {
+		case r.dumps:
+			s, err = r.nextDump()
+		case r.v2:
+			s, err = r.nextV2()
+		default:
+			s, err = r.nextV1()
+		}
+
+		switch {
+		case err == nil:
+			return s, nil
+		case err != io.EOF:
+			var d *Diagnostic
+			if r.name != "" && !errors.As(err, &d) {
+				err = fmt.Errorf("%s: %w", r.name, err)
+			}
+
+			return nil, err
+		case len(r.paths) == 0:
+			return nil, io.EOF
+		}
+
+		if err := r.openNext(); err != nil {
+			return nil, err
+		}
+	}
+}
+
+// All returns an iterator over the remaining samples. Iteration stops after the first error.
+func (r *Reader) All() iter.Seq2[*StackSample, error] {
+	return func(yield func(*StackSample, error) bool) {
+		for {
+			s, err := r.Next()
+			if err == io.EOF {
+				return
+			}
+
+			if !yield(s, err) || err != nil {
+				return
+			}
+		}
+	}
+}
+
+// Close releases the input, and stops any workers parsing samples.
+func (r *Reader) Close() error {
+	r.stopWorkers()
+
+	return r.closeSource()
+}
+
+// closeSource closes the current input.
+func (r *Reader) closeSource() error {
+	var err error
+
+	if r.src != nil {
+		err = r.src.Close()
+	}
+
+	if r.file != nil {
+		if cerr := r.file.Close(); err == nil {
+			err = cerr
+		}
+	}
+
+	return err
+}
+
+// openNext closes the current segment of a file, and opens the next.
+func (r *Reader) openNext() error {
+	if err := r.closeSource(); err != nil {
+		return err
+	}
+
+	r.src, r.file = nil, nil
+
+	r.name, r.paths = r.paths[0], r.paths[1:]
+
+	f, err := os.Open(r.name)
+	if err != nil {
+		return err
+	}
+
+	r.file = f
+
+	if r.dumps {
+		fi, err := f.Stat()
+		if err != nil {
+			return err
+		}
+
+		r.stamp = fileStamp(r.name, fi.ModTime())
+	}
+
+	if err := r.reset(f); err != nil {
+		return fmt.Errorf("%s: %w", r.name, err)
+	}
+
+	return nil
+}
+
+// reset starts reading from a new input, detecting its compression and format. Attempts to fetch stacks since the
+// last sample are kept for the next one, which may be in a later segment.
+func (r *Reader) reset(in io.Reader) error {
+	src, err := decompress(in)
+	if err != nil {
+		return err
+	}
+
+	br := bufio.NewReader(src)
+	head, _ := br.Peek(len(logformat.V2Magic))
+
+	r.src = src
+	r.lines = bufio.NewScanner(br)
+	r.v2 = !r.dumps && string(head) == logformat.V2Magic
+	r.n = 0
+	r.offset = 0
+	r.next = 0
+	r.started = false
+	r.ended = false
+	r.frames = map[int]string{}
+	r.gs = map[int]*v2Goroutine{}
+	r.events = []*Event{}
+
+	if r.v2 || r.dumps {
+		r.lines.Buffer(make([]byte, 64*1024), maxLine)
+	}
+
+	return nil
+}
+
+// readAll reads every remaining sample into a log.
+func readAll(r *Reader) (*Log, error) {
+	l := &Log{Samples: []*StackSample{}}
+
+	for s, err := range r.All() {
+		if err != nil {
+			l.Metadata = r.Metadata()
+			return l, err
+		}
+
+		l.Samples = append(l.Samples, s)
+	}
+
+	l.Metadata = r.Metadata()
+	l.Fetches = r.Fetches()
+
+	return l, nil
+}
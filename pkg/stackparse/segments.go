@@ -0,0 +1,55 @@
+/*
+Copyright 2020 Google LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package stackparse
+
+import (
+	"os"
+
+	"github.com/google/slowjam/internal/logformat"
+)
+
+// SegmentPath returns the path of the nth segment of a rotated stack log, numbering it before the file extension:
+// out.slog.gz, out.1.slog.gz, out.2.slog.gz. The first segment is the path itself.
+func SegmentPath(path string, n int) string {
+	return logformat.SegmentPath(path, n)
+}
+
+// Segments returns path along with any rotated segments that follow it, in order.
+func Segments(path string) []string {
+	paths := []string{path}
+
+	for n := 1; ; n++ {
+		p := SegmentPath(path, n)
+		if _, err := os.Stat(p); err != nil {
+			return paths
+		}
+
+		paths = append(paths, p)
+	}
+}
+
+// ReadFile parses a stack log file, along with any rotated segments that follow it, as one continuous log. Metadata
+// is taken from the first segment. To analyze logs which may not fit in memory, use OpenFile instead.
+func ReadFile(path string) (*Log, error) {
+	r, err := OpenFile(path)
+	if err != nil {
+		return &Log{Samples: []*StackSample{}}, err
+	}
+	defer r.Close()
+
+	return readAll(r)
+}
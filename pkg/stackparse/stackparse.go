@@ -18,11 +18,9 @@ limitations under the License.
 package stackparse
 
 import (
-	"bufio"
 	"bytes"
 	"fmt"
 	"io"
-	"os"
 	"strconv"
 	"strings"
 	"time"
@@ -32,26 +30,86 @@ import (
 
 // StackSample represents a single Go stack at a point in time.
 type StackSample struct {
-	Time    time.Time
+	// Time is when the sample was taken. It is measured on the monotonic clock when the log records one, and never
+	// runs backwards.
+	Time time.Time
+	// Wall is the wall clock time when the sample was taken, which may jump when the clock is adjusted.
+	Wall    time.Time
 	Context *stack.Snapshot
+	// Events were recorded by the program since the previous sample.
+	Events []*Event
+	// Labels are the runtime/pprof labels of each goroutine, by goroutine ID, if they were recorded.
+	Labels map[int]Labels
+	// Metrics are runtime/metrics values read alongside the stacks, by name, if they were recorded.
+	Metrics map[string]float64
+	// Overhead is the time the sampler took to record this sample, if it was recorded.
+	Overhead time.Duration
+	// Pause is how long the sampler stopped the world to capture the stacks, if it was recorded.
+	Pause time.Duration
+	// Fetches are the attempts to fetch stacks from another process since the previous sample, including any which
+	// failed, if they were recorded.
+	Fetches []*Fetch
+
+	// raw is the runtime.Stack output of the sample, until its goroutines are parsed
+	raw []byte
+	// line and offset locate the end of the sample in its log, for diagnostics
+	line   int
+	offset int64
+}
+
+// Fetch is an attempt to fetch stacks from another process, such as a goroutine dump from net/http/pprof.
+type Fetch struct {
+	Time    time.Time
+	Latency time.Duration
+	// Err describes why the attempt failed, if it did.
+	Err string
 }
 
-// Read parses a stack log input.
+// Log is a parsed stack log.
+type Log struct {
+	// Metadata describes the recorded process, if the log format carries it.
+	Metadata *Metadata
+	Samples  []*StackSample
+	// Fetches are the attempts to fetch stacks from another process which were not followed by a sample, such as
+	// when every attempt failed.
+	Fetches []*Fetch
+}
+
+// Read parses a stack log input, which may be gzip or zstd compressed.
 func Read(r io.Reader) ([]*StackSample, error) {
+	l, err := ReadLog(r)
+	return l.Samples, err
+}
+
+// ReadLog parses a stack log input, including any metadata recorded alongside the samples. To analyze logs which may
+// not fit in memory, use NewReader instead.
+func ReadLog(r io.Reader) (*Log, error) {
+	sr, err := NewReader(r)
+	if err != nil {
+		return &Log{Samples: []*StackSample{}}, err
+	}
+	defer sr.Close()
+
+	return readAll(sr)
+}
+
+// nextV1 parses the next sample of a stack log that records the full output of runtime.Stack for every sample.
+func (r *Reader) nextV1() (*StackSample, error) {
 	inStack := false
 	t := time.Time{}
 	sd := bytes.NewBuffer([]byte{})
-	samples := []*StackSample{}
 
-	scanner := bufio.NewScanner(r)
-
-	for scanner.Scan() {
+	for r.scan() {
 		if !inStack {
-			line := scanner.Text()
+			line := r.lines.Text()
 
 			s, err := strconv.ParseInt(line, 10, 64)
 			if err != nil {
-				return samples, err
+				if err := r.problem(fmt.Errorf("timestamp: %w", err)); err != nil {
+					return nil, err
+				}
+
+				continue
 			}
 
 			t = time.Unix(0, s)
@@ -60,28 +118,60 @@ func Read(r io.Reader) ([]*StackSample, error) {
 			continue
 		}
 
-		if strings.HasPrefix(scanner.Text(), "-") {
-			inStack = false
+		if strings.HasPrefix(r.lines.Text(), "-") {
+			return &StackSample{Time: t, raw: sd.Bytes(), line: r.n, offset: r.offset}, nil
+		}
 
-			ctx, _, err := stack.ScanSnapshot(sd, os.Stdout, &stack.Opts{})
-			if err != nil && err != io.EOF {
-				return samples, err
-			}
+		sd.Write(r.lines.Bytes())
+		sd.Write([]byte{'\n'})
+	}
 
-			samples = append(samples, &StackSample{Time: t, Context: ctx})
+	if err := r.scanErr(); err != nil {
+		return nil, err
+	}
 
-			continue
+	// The final sample of a process which was killed lacks its terminator
+	if inStack && (sd.Len() > 0 || !r.tolerant) {
+		if err := r.truncated(r.n, r.offset); err != nil {
+			return nil, err
 		}
 
-		sd.Write(scanner.Bytes())
-		sd.Write([]byte{'\n'})
+		return &StackSample{Time: t, raw: sd.Bytes(), line: r.n, offset: r.offset}, nil
 	}
 
-	if err := scanner.Err(); err != nil {
-		return samples, err
+	return nil, io.EOF
+}
+
+// scan parses the goroutines of a sample from its runtime.Stack output.
+func (s *StackSample) scan() error {
+	labels, bs := extractLabels(s.raw)
+	s.raw = nil
+
+	ctx, _, err := stack.ScanSnapshot(bytes.NewReader(bs), io.Discard, &stack.Opts{})
+	if err != nil && err != io.EOF {
+		return err
+	}
+
+	// Every goroutine may have been filtered out when recording
+	if ctx == nil {
+		ctx = &stack.Snapshot{}
+	}
+
+	s.Context = ctx
+	s.Labels = labels
+
+	return nil
+}
+
+// NewSample parses a sample taken at t from goroutines in the text format of runtime.Stack, such as those converted
+// from another profile format.
+func NewSample(t time.Time, stacks []byte) (*StackSample, error) {
+	s := &StackSample{Time: t, Wall: t, raw: stacks}
+	if err := s.scan(); err != nil {
+		return nil, err
 	}
 
-	return samples, nil
+	return s, nil
 }
 
 // PkgDotName returns a package-qualified function name.
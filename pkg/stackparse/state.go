@@ -0,0 +1,132 @@
+/*
+Copyright 2020 Google LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package stackparse
+
+import (
+	"strings"
+	"time"
+)
+
+// StateClass is a coarse classification of goroutine states.
+type StateClass string
+
+const (
+	// StateRunning is a goroutine that is running or waiting to run.
+	StateRunning StateClass = "running"
+	// StateSyscall is a goroutine blocked in a system call, such as waiting for a child process.
+	StateSyscall StateClass = "syscall"
+	// StateIO is a goroutine waiting on network I/O.
+	StateIO StateClass = "io"
+	// StateLock is a goroutine waiting on a mutex, wait group, or other sync primitive.
+	StateLock StateClass = "lock"
+	// StateChannel is a goroutine waiting on a channel operation or select.
+	StateChannel StateClass = "channel"
+	// StateSleep is a goroutine in time.Sleep.
+	StateSleep StateClass = "sleep"
+	// StateOther is any other state, such as the garbage collector.
+	StateOther StateClass = "other"
+)
+
+// StateClasses lists every state class, in display order.
+var StateClasses = []StateClass{StateRunning, StateSyscall, StateIO, StateLock, StateChannel, StateSleep, StateOther}
+
+// Description returns a human-readable description of a state class.
+func (c StateClass) Description() string {
+	switch c {
+	case StateRunning:
+		return "running"
+	case StateSyscall:
+		return "in syscalls"
+	case StateIO:
+		return "waiting on I/O"
+	case StateLock:
+		return "waiting on locks"
+	case StateChannel:
+		return "waiting on channels"
+	case StateSleep:
+		return "sleeping"
+	default:
+		return "other"
+	}
+}
+
+// ClassifyState classifies a goroutine state, such as "chan receive" or "IO wait", as reported by the runtime.
+func ClassifyState(state string) StateClass {
+	switch {
+	case state == "running" || state == "runnable":
+		return StateRunning
+	case state == "syscall":
+		return StateSyscall
+	case state == "IO wait":
+		return StateIO
+	case strings.HasPrefix(state, "semacquire"), strings.HasPrefix(state, "sync."):
+		return StateLock
+	case strings.HasPrefix(state, "chan "), strings.HasPrefix(state, "select"):
+		return StateChannel
+	case state == "sleep":
+		return StateSleep
+	default:
+		return StateOther
+	}
+}
+
+// StateTimes totals the time spent in each goroutine state, as estimated from the samples it was seen in.
+type StateTimes map[string]time.Duration
+
+// Classes totals the time by state class.
+func (st StateTimes) Classes() map[StateClass]time.Duration {
+	cs := map[StateClass]time.Duration{}
+	for s, d := range st {
+		cs[ClassifyState(s)] += d
+	}
+
+	return cs
+}
+
+// Dominant returns the state class the most time was spent in.
+func (st StateTimes) Dominant() StateClass {
+	cs := st.Classes()
+
+	best := StateOther
+	bestD := time.Duration(0)
+
+	for _, c := range StateClasses {
+		if cs[c] > bestD {
+			best = c
+			bestD = cs[c]
+		}
+	}
+
+	return best
+}
+
+// Total returns the time spent in all states.
+func (st StateTimes) Total() time.Duration {
+	total := time.Duration(0)
+	for _, d := range st {
+		total += d
+	}
+
+	return total
+}
+
+// Add adds the times of another set of states.
+func (st StateTimes) Add(o StateTimes) {
+	for s, d := range o {
+		st[s] += d
+	}
+}
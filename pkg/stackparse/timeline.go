@@ -17,6 +17,8 @@ limitations under the License.
 package stackparse
 
 import (
+	"fmt"
+	"sort"
 	"strings"
 	"time"
 
@@ -42,6 +44,88 @@ type Timeline struct {
 	End        time.Time
 	Samples    int
 	Goroutines map[int]*GoroutineTimeline
+	// Metadata describes the recorded process, if known.
+	Metadata *Metadata
+	// Markers are annotations recorded by the program, ordered by start time.
+	Markers []*Marker
+	// Metrics are time series of runtime/metrics values, by name.
+	Metrics map[string][]MetricPoint
+	// Overhead is the total time the sampler spent recording samples, if it was recorded.
+	Overhead time.Duration
+	// Pauses are the times the sampler stopped the world to capture stacks, if they were recorded.
+	Pauses []*Pause
+	// Fetches are the attempts to fetch stacks from another process, if the stacks were fetched from one.
+	Fetches []*FetchSpan
+	// Gaps are wall clock jumps and stretches without samples, during which durations may be misleading.
+	Gaps []*Gap
+	// Processes are the timelines of each process, if this timeline was merged from several. Goroutines are then
+	// found within the processes.
+	Processes []*Process
+}
+
+// Pause is a period during which the sampler stopped the world.
+type Pause struct {
+	StartDelta time.Duration
+	EndDelta   time.Duration
+}
+
+// FetchSpan is an attempt to fetch stacks from another process, during which the process kept running.
+type FetchSpan struct {
+	StartDelta time.Duration
+	EndDelta   time.Duration
+	// Err describes why the attempt failed, if it did.
+	Err string
+}
+
+// SlowestFetch returns the longest time taken to fetch stacks from another process.
+func (tl *Timeline) SlowestFetch() time.Duration {
+	slowest := time.Duration(0)
+
+	for _, proc := range tl.Procs() {
+		for _, f := range proc.Timeline.Fetches {
+			if d := f.EndDelta - f.StartDelta; d > slowest {
+				slowest = d
+			}
+		}
+	}
+
+	return slowest
+}
+
+// FailedFetches returns how many attempts to fetch stacks from another process failed.
+func (tl *Timeline) FailedFetches() int {
+	n := 0
+
+	for _, proc := range tl.Procs() {
+		for _, f := range proc.Timeline.Fetches {
+			if f.Err != "" {
+				n++
+			}
+		}
+	}
+
+	return n
+}
+
+// WorstPause returns the longest time the sampler stopped the world for.
+func (tl *Timeline) WorstPause() time.Duration {
+	worst := time.Duration(0)
+
+	for _, proc := range tl.Procs() {
+		for _, p := range proc.Timeline.Pauses {
+			if d := p.EndDelta - p.StartDelta; d > worst {
+				worst = d
+			}
+		}
+	}
+
+	return worst
+}
+
+// MetricPoint is the value of a runtime metric at a point in the timeline.
+type MetricPoint struct {
+	Delta time.Duration
+	Value float64
 }
 
 // GoroutineTimeline represents a time series for an individual goroutine.
@@ -49,6 +133,27 @@ type GoroutineTimeline struct {
 	ID        int
 	Signature stack.Signature
 	Layers    []*Layer
+	// Labels are the most recently seen runtime/pprof labels of the goroutine.
+	Labels Labels
+	// Group is the value of the TimelineOptions.GroupBy label, used to cluster related goroutines.
+	Group string
+	// States estimates the time this goroutine spent in each state.
+	States StateTimes
+}
+
+// TimelineOptions controls which goroutines are included in a timeline, and how they are grouped.
+type TimelineOptions struct {
+	// IgnoreCreators excludes goroutines created by these functions.
+	IgnoreCreators []string
+	// Goroutines only includes these goroutine IDs.
+	Goroutines []int
+	// Labels only includes goroutines while they have all of these label values.
+	Labels map[string]string
+	// GroupBy groups goroutines by the value of this label.
+	GroupBy string
+	// Metadata describes the recorded process, such as Log.Metadata, and becomes Timeline.Metadata. How often the
+	// process was sampled tells gaps in sampling from an adaptive sampler backing off.
+	Metadata *Metadata
 }
 
 // Layer is a layer in a call stack.
@@ -65,10 +170,21 @@ type Call struct {
 	Args       stack.Args
 	Name       string
 	Package    string
+	// States estimates the time this call spent in each goroutine state, such as "IO wait".
+	States StateTimes
 }
 
 // SimplifyTimeline flattens overlapping layers from call-stacks in a timeline.
 func SimplifyTimeline(tl *Timeline) *Timeline {
+	if len(tl.Processes) > 0 {
+		ps := []*Process{}
+		for _, p := range tl.Processes {
+			ps = append(ps, &Process{Name: p.Name, Offset: p.Offset, Duration: p.Duration, Timeline: SimplifyTimeline(p.Timeline)})
+		}
+
+		return &Timeline{Start: tl.Start, End: tl.End, Samples: tl.Samples, Goroutines: tl.Goroutines, Overhead: tl.Overhead, Processes: ps}
+	}
+
 	newGoroutines := map[int]*GoroutineTimeline{}
 
 	for gid, g := range tl.Goroutines {
@@ -78,8 +194,9 @@ func SimplifyTimeline(tl *Timeline) *Timeline {
 			newCalls := []*Call{}
 
 			for _, c := range l.Calls {
-				// If it's less than .25%, omit
-				if c.Samples*250 < tl.Samples {
+				// If it's less than 1/250th of the time sampled, omit. Time rather than sample counts are compared, as
+				// the interval between samples may vary.
+				if c.States.Total()*250 < tl.End.Sub(tl.Start) {
 					klog.V(1).Infof("%d: dropping %s due to sample size (%d, duration %s)\n", gid, c.Name, c.Samples, c.EndDelta-c.StartDelta)
 					continue
 				}
@@ -119,7 +236,7 @@ func SimplifyTimeline(tl *Timeline) *Timeline {
 			continue
 		}
 
-		newGoroutines[gid] = &GoroutineTimeline{g.ID, g.Signature, newLayers}
+		newGoroutines[gid] = &GoroutineTimeline{ID: g.ID, Signature: g.Signature, Layers: newLayers, Labels: g.Labels, Group: g.Group, States: g.States}
 	}
 
 	klog.V(1).Infof("Simplify was able to reduce visible goroutines from %d to %d\n", len(tl.Goroutines), len(newGoroutines))
@@ -129,99 +246,264 @@ func SimplifyTimeline(tl *Timeline) *Timeline {
 		End:        tl.End,
 		Samples:    tl.Samples,
 		Goroutines: newGoroutines,
+		Metadata:   tl.Metadata,
+		Markers:    tl.Markers,
+		Metrics:    tl.Metrics,
+		Overhead:   tl.Overhead,
+		Pauses:     tl.Pauses,
+		Fetches:    tl.Fetches,
+		Gaps:       tl.Gaps,
 	}
 }
 
 // CreateTimeline creates a timeline from stack samples.
 func CreateTimeline(samples []*StackSample, ignoreCreators []string, goroutines []int) *Timeline {
-	ig := map[string]bool{}
-	for _, i := range ignoreCreators {
-		ig[i] = true
+	return CreateTimelineWithOptions(samples, TimelineOptions{IgnoreCreators: ignoreCreators, Goroutines: goroutines})
+}
+
+// CreateTimelineWithOptions creates a timeline from stack samples, filtering and grouping goroutines.
+func CreateTimelineWithOptions(samples []*StackSample, o TimelineOptions) *Timeline {
+	b := NewTimelineBuilder(o)
+	for _, s := range samples {
+		b.Add(s)
 	}
 
-	gorm := map[int]bool{}
-	for _, i := range goroutines {
-		gorm[i] = true
+	return b.Timeline()
+}
+
+// TimelineBuilder creates a timeline one sample at a time, so that samples need not be kept in memory. Samples must
+// be added in order.
+type TimelineBuilder struct {
+	o    TimelineOptions
+	ig   map[string]bool
+	gorm map[int]bool
+	tl   *Timeline
+
+	prev   time.Time
+	events []*Event
+	gaps   gapFinder
+	// owed are the states credited with the previous sample, which are owed half of the interval to the next one
+	owed []owedState
+}
+
+// owedState is a goroutine state which a sample was seen in.
+type owedState struct {
+	st    StateTimes
+	state string
+}
+
+// NewTimelineBuilder returns a builder for a timeline, filtering and grouping goroutines.
+func NewTimelineBuilder(o TimelineOptions) *TimelineBuilder {
+	b := &TimelineBuilder{
+		o:    o,
+		ig:   map[string]bool{},
+		gorm: map[int]bool{},
+		tl:   &Timeline{Goroutines: map[int]*GoroutineTimeline{}},
 	}
 
-	tl := &Timeline{
-		Start:      samples[0].Time,
-		End:        samples[len(samples)-1].Time,
-		Goroutines: map[int]*GoroutineTimeline{},
+	for _, i := range o.IgnoreCreators {
+		b.ig[i] = true
 	}
 
-	for _, s := range samples {
-		tl.Samples++
+	for _, i := range o.Goroutines {
+		b.gorm[i] = true
+	}
 
-		for _, g := range s.Context.Goroutines {
-			if len(g.CreatedBy.Calls) != 0 && ig[PkgDotName(g.CreatedBy.Calls[0].Func)] {
-				continue
-			}
+	if o.Metadata != nil {
+		b.SetMetadata(o.Metadata)
+	}
 
-			if len(gorm) > 0 && !gorm[g.ID] {
-				continue
+	return b
+}
+
+// Add adds the next sample to the timeline. Each sample stands for half of the interval to each neighboring sample,
+// as the interval between samples may vary.
+func (b *TimelineBuilder) Add(s *StackSample) {
+	tl := b.tl
+
+	if tl.Samples == 0 {
+		tl.Start = s.Time
+		b.gaps.start = s.Time
+	}
+
+	tl.End = s.Time
+	tl.Samples++
+	tl.Overhead += s.Overhead
+
+	w := time.Duration(0)
+	if !b.prev.IsZero() {
+		w = s.Time.Sub(b.prev) / 2
+	}
+
+	b.prev = s.Time
+
+	for _, o := range b.owed {
+		o.st[o.state] += w
+	}
+
+	b.owed = b.owed[:0]
+	b.events = append(b.events, s.Events...)
+	b.gaps.add(s)
+
+	if s.Pause > 0 {
+		start := s.Time.Sub(tl.Start)
+		tl.Pauses = append(tl.Pauses, &Pause{StartDelta: start, EndDelta: start + s.Pause})
+	}
+
+	for _, f := range s.Fetches {
+		// Attempts which failed before the first sample are drawn at its start
+		start := max(f.Time.Sub(tl.Start), 0)
+		tl.Fetches = append(tl.Fetches, &FetchSpan{StartDelta: start, EndDelta: start + f.Latency, Err: f.Err})
+	}
+
+	for name, v := range s.Metrics {
+		if tl.Metrics == nil {
+			tl.Metrics = map[string][]MetricPoint{}
+		}
+
+		tl.Metrics[name] = append(tl.Metrics[name], MetricPoint{Delta: s.Time.Sub(tl.Start), Value: v})
+	}
+
+	for _, g := range s.Context.Goroutines {
+		b.addGoroutine(s, g, w)
+	}
+}
+
+// AddFetches adds attempts to fetch stacks which were not followed by a sample, such as those of Reader.Fetches, once
+// every sample has been added. A timeline without samples spans the attempts.
+func (b *TimelineBuilder) AddFetches(fs []*Fetch) {
+	tl := b.tl
+
+	for _, f := range fs {
+		if tl.Samples == 0 {
+			if len(tl.Fetches) == 0 {
+				tl.Start = f.Time
 			}
 
-			if tl.Goroutines[g.ID] == nil {
-				tl.Goroutines[g.ID] = &GoroutineTimeline{
-					ID:        g.ID,
-					Signature: g.Signature,
-					Layers:    []*Layer{},
-				}
+			if end := f.Time.Add(f.Latency); end.After(tl.End) {
+				tl.End = end
 			}
+		}
 
-			for depth, c := range g.Signature.Stack.Calls {
-				if InternalCall(c) {
-					continue
-				}
+		start := max(f.Time.Sub(tl.Start), 0)
+		tl.Fetches = append(tl.Fetches, &FetchSpan{StartDelta: start, EndDelta: start + f.Latency, Err: f.Err})
+	}
+}
 
-				thisCall := &Call{
-					StartDelta: s.Time.Sub(tl.Start),
-					Name:       PkgDotName(c.Func),
-					Package:    c.Func.DirName,
-					Args:       c.Args,
-					lastSeen:   s.Time,
-					Samples:    1,
-				}
+// addGoroutine adds a goroutine seen in a sample, which stands for w since the previous sample.
+func (b *TimelineBuilder) addGoroutine(s *StackSample, g *stack.Goroutine, w time.Duration) {
+	tl := b.tl
+	o := b.o
 
-				level := len(g.Signature.Stack.Calls) - depth - 1
-				// New layer!
-				missing := level - (len(tl.Goroutines[g.ID].Layers) - 1)
+	if len(g.CreatedBy.Calls) != 0 && b.ig[PkgDotName(g.CreatedBy.Calls[0].Func)] {
+		return
+	}
 
-				if missing > 0 {
-					for i := 0; i < missing; i++ {
-						tl.Goroutines[g.ID].Layers = append(tl.Goroutines[g.ID].Layers, &Layer{Calls: []*Call{}})
-					}
+	if len(b.gorm) > 0 && !b.gorm[g.ID] {
+		return
+	}
 
-					tl.Goroutines[g.ID].Layers[level].Calls = []*Call{thisCall}
+	labels := s.Labels[g.ID]
+	if len(o.Labels) > 0 && !labels.Matches(o.Labels) {
+		return
+	}
 
-					continue
-				}
+	if tl.Goroutines[g.ID] == nil {
+		tl.Goroutines[g.ID] = &GoroutineTimeline{
+			ID:        g.ID,
+			Signature: g.Signature,
+			Layers:    []*Layer{},
+			States:    StateTimes{},
+		}
+	}
 
-				// Existing layer
-				calls := tl.Goroutines[g.ID].Layers[level].Calls
-				if len(calls) == 0 {
-					tl.Goroutines[g.ID].Layers[level].Calls = []*Call{thisCall}
+	tl.Goroutines[g.ID].States[g.State] += w
+	b.owe(tl.Goroutines[g.ID].States, g.State)
 
-					continue
-				}
+	if labels != nil {
+		tl.Goroutines[g.ID].Labels = labels
+	}
 
-				lc := calls[len(calls)-1]
-				// Existing call with the same name or short sample size
-				if lc.Name == PkgDotName(c.Func) && lc.EndDelta == 0 && (lc.Samples < 3 || SameArgs(lc.Args, c.Args)) {
-					lc.Samples++
-					lc.lastSeen = s.Time
+	if o.GroupBy != "" && tl.Goroutines[g.ID].Group == "" && labels[o.GroupBy] != "" {
+		tl.Goroutines[g.ID].Group = fmt.Sprintf("%s=%s", o.GroupBy, labels[o.GroupBy])
+	}
 
-					continue
-				}
+	for depth, c := range g.Signature.Stack.Calls {
+		if InternalCall(c) {
+			continue
+		}
 
-				// End the previous call & add a new one
-				// Err on the smaller time-scale: was this a 1ms call or a 100ms call?
-				lc.EndDelta = lc.lastSeen.Sub(tl.Start)
-				tl.Goroutines[g.ID].Layers[level].Calls = append(tl.Goroutines[g.ID].Layers[level].Calls, thisCall)
+		thisCall := &Call{
+			StartDelta: s.Time.Sub(tl.Start),
+			Name:       PkgDotName(c.Func),
+			Package:    c.Func.DirName,
+			Args:       c.Args,
+			lastSeen:   s.Time,
+			Samples:    1,
+			States:     StateTimes{g.State: w},
+		}
+
+		level := len(g.Signature.Stack.Calls) - depth - 1
+		// New layer!
+		missing := level - (len(tl.Goroutines[g.ID].Layers) - 1)
+
+		if missing > 0 {
+			for i := 0; i < missing; i++ {
+				tl.Goroutines[g.ID].Layers = append(tl.Goroutines[g.ID].Layers, &Layer{Calls: []*Call{}})
 			}
+
+			tl.Goroutines[g.ID].Layers[level].Calls = []*Call{thisCall}
+			b.owe(thisCall.States, g.State)
+
+			continue
+		}
+
+		// Existing layer
+		calls := tl.Goroutines[g.ID].Layers[level].Calls
+		if len(calls) == 0 {
+			tl.Goroutines[g.ID].Layers[level].Calls = []*Call{thisCall}
+			b.owe(thisCall.States, g.State)
+
+			continue
+		}
+
+		lc := calls[len(calls)-1]
+		// Existing call with the same name or short sample size
+		if lc.Name == PkgDotName(c.Func) && lc.EndDelta == 0 && (lc.Samples < 3 || SameArgs(lc.Args, c.Args)) {
+			lc.Samples++
+			lc.lastSeen = s.Time
+			lc.States[g.State] += w
+			b.owe(lc.States, g.State)
+
+			continue
 		}
+
+		// End the previous call & add a new one
+		// Err on the smaller time-scale: was this a 1ms call or a 100ms call?
+		lc.EndDelta = lc.lastSeen.Sub(tl.Start)
+		tl.Goroutines[g.ID].Layers[level].Calls = append(tl.Goroutines[g.ID].Layers[level].Calls, thisCall)
+		b.owe(thisCall.States, g.State)
 	}
+}
+
+// owe records that a state is owed half of the interval to the next sample.
+func (b *TimelineBuilder) owe(st StateTimes, state string) {
+	b.owed = append(b.owed, owedState{st: st, state: state})
+}
+
+// SetMetadata describes the recorded process, in place of TimelineOptions.Metadata, for logs whose metadata is only
+// known once they have been read.
+func (b *TimelineBuilder) SetMetadata(md *Metadata) {
+	b.tl.Metadata = md
+	b.gaps.slowest = slowestPoll(md)
+}
+
+// Timeline returns the timeline of the samples added so far. The builder should not be used afterwards.
+func (b *TimelineBuilder) Timeline() *Timeline {
+	tl := b.tl
+
+	tl.Markers = createMarkers(b.events, tl.Start, tl.End)
+	tl.Gaps = b.gaps.result()
 
 	// End any trailing calls
 	for _, g := range tl.Goroutines {
@@ -276,3 +558,21 @@ func SameArgs(a stack.Args, b stack.Args) bool {
 
 	return true
 }
+
+// SortedGoroutines returns the goroutines of a timeline, ordered by group and then ID.
+func SortedGoroutines(tl *Timeline) []*GoroutineTimeline {
+	gs := []*GoroutineTimeline{}
+	for _, g := range tl.Goroutines {
+		gs = append(gs, g)
+	}
+
+	sort.Slice(gs, func(i, j int) bool {
+		if gs[i].Group != gs[j].Group {
+			return gs[i].Group < gs[j].Group
+		}
+
+		return gs[i].ID < gs[j].ID
+	})
+
+	return gs
+}
@@ -0,0 +1,67 @@
+/*
+Copyright 2020 Google LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package stackparse
+
+import (
+	"testing"
+	"time"
+)
+
+// backedOff returns samples taken every 100ms, with a 3s interval in the middle, as an adaptive sampler leaves
+// while stacks are static.
+func backedOff(t *testing.T) []*StackSample {
+	t.Helper()
+
+	stacks := []byte("goroutine 1 [running]:\nmain.main()\n\t/app/main.go:10 +0x1d\n\n")
+	at := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	samples := []*StackSample{}
+
+	for i := 0; i < 40; i++ {
+		if i == 20 {
+			at = at.Add(3 * time.Second)
+		} else {
+			at = at.Add(100 * time.Millisecond)
+		}
+
+		s, err := NewSample(at, stacks)
+		if err != nil {
+			t.Fatalf("NewSample: %v", err)
+		}
+
+		samples = append(samples, s)
+	}
+
+	return samples
+}
+
+func TestCreateTimelineMetadata(t *testing.T) {
+	tl := CreateTimelineWithOptions(backedOff(t), TimelineOptions{})
+	if len(tl.Gaps) != 1 {
+		t.Errorf("without metadata, got gaps %v, want the 3s interval", tl.Gaps)
+	}
+
+	md := &Metadata{Poll: 100 * time.Millisecond, MaxPoll: 2 * time.Second}
+
+	tl = CreateTimelineWithOptions(backedOff(t), TimelineOptions{Metadata: md})
+	if len(tl.Gaps) != 0 {
+		t.Errorf("with an adaptive sampler backing off to 2s, got gaps %v, want none", tl.Gaps)
+	}
+
+	if tl.Metadata != md {
+		t.Errorf("timeline metadata = %v, want %v", tl.Metadata, md)
+	}
+}
@@ -0,0 +1,377 @@
+/*
+Copyright 2020 Google LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package stackparse
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/google/slowjam/internal/logformat"
+)
+
+// maxLine is the longest line accepted in a v2 stack log.
+const maxLine = 1024 * 1024
+
+// v2Goroutine is the most recently recorded state of a goroutine.
+type v2Goroutine struct {
+	header string
+	frames []int
+}
+
+// nextV2 parses the next sample of a v2 stack log, reconstructing its full stack. As the overhead of a sample is
+// recorded after it, each sample is held until the record which follows it has been read.
+func (r *Reader) nextV2() (*StackSample, error) {
+	for r.scan() {
+		line := r.lines.Text()
+
+		// Concatenated segments each start afresh
+		if line == logformat.V2Magic {
+			r.frames = map[int]string{}
+			r.gs = map[int]*v2Goroutine{}
+
+			if s := r.release(); s != nil {
+				return s, nil
+			}
+
+			continue
+		}
+
+		tag, rest, _ := strings.Cut(line, " ")
+
+		s, err := r.parseV2(tag, rest)
+		if err != nil {
+			if err := r.problem(err); err != nil {
+				return nil, err
+			}
+
+			continue
+		}
+
+		if s != nil {
+			return s, nil
+		}
+
+		if tag != "M" && tag != "L" && tag != "O" && tag != "-" {
+			if s := r.release(); s != nil {
+				return s, nil
+			}
+		}
+	}
+
+	if err := r.scanErr(); err != nil {
+		return nil, err
+	}
+
+	// The final sample of a process which was killed lacks its terminator. Markers recorded before it belong to it.
+	if r.started {
+		if s := r.release(); s != nil {
+			return s, nil
+		}
+
+		if err := r.truncated(r.n, r.offset); err != nil {
+			return nil, err
+		}
+
+		return r.finishSample()
+	}
+
+	// Markers and fetches recorded after the final sample belong with it
+	if r.pending != nil && len(r.events) > 0 {
+		r.pending.Events = append(r.pending.Events, r.events...)
+		r.events = []*Event{}
+	}
+
+	if r.pending != nil && len(r.fetches) > 0 {
+		r.pending.Fetches = append(r.pending.Fetches, r.fetches...)
+		r.fetches = nil
+	}
+
+	if s := r.release(); s != nil {
+		return s, nil
+	}
+
+	return nil, io.EOF
+}
+
+// finishSample creates a sample from the current goroutine state.
+func (r *Reader) finishSample() (*StackSample, error) {
+	r.started = false
+
+	if r.tolerant {
+		r.dropUndefined()
+	}
+
+	sd, err := v2Stacks(r.gs, r.frames)
+	if err != nil {
+		return nil, err
+	}
+
+	s := &StackSample{Time: r.t, Wall: r.wall, Metrics: r.vals, raw: sd.Bytes(), line: r.n, offset: r.offset}
+
+	if len(r.events) > 0 {
+		s.Events = r.events
+		r.events = []*Event{}
+	}
+
+	s.Fetches = r.fetches
+	r.fetches = nil
+
+	return s, nil
+}
+
+// dropUndefined removes goroutines which refer to frames that were never defined, such as when a frame record was
+// corrupt, recording a diagnostic for each.
+func (r *Reader) dropUndefined() {
+	for id, g := range r.gs {
+		for _, fid := range g.frames {
+			if _, ok := r.frames[fid]; !ok {
+				_ = r.problem(fmt.Errorf("goroutine %d: undefined frame %d", id, fid))
+				delete(r.gs, id)
+
+				break
+			}
+		}
+	}
+}
+
+// release returns the sample being held, if any.
+func (r *Reader) release() *StackSample {
+	s := r.pending
+	r.pending = nil
+
+	return s
+}
+
+// parseV2 applies a single record of a v2 stack log. It returns the previously held sample if a new one is complete
+// before it was released.
+func (r *Reader) parseV2(tag string, rest string) (*StackSample, error) {
+	switch tag {
+	case "H":
+		md := &Metadata{}
+		if err := json.Unmarshal([]byte(rest), md); err != nil {
+			return nil, fmt.Errorf("header: %w", err)
+		}
+
+		if r.md == nil {
+			r.md = md
+		}
+	case "M":
+		ev := struct {
+			T    int64     `json:"t"`
+			Mono *int64    `json:"m"`
+			Kind EventKind `json:"kind"`
+			Name string    `json:"name"`
+		}{}
+		if err := json.Unmarshal([]byte(rest), &ev); err != nil {
+			return nil, fmt.Errorf("marker: %w", err)
+		}
+
+		r.events = append(r.events, &Event{Time: monotonic(r.md, time.Unix(0, ev.T), ev.Mono), Kind: ev.Kind, Name: ev.Name})
+	case "L":
+		f := struct {
+			T    int64  `json:"t"`
+			Mono *int64 `json:"m"`
+			D    int64  `json:"d"`
+			Err  string `json:"err"`
+		}{}
+		if err := json.Unmarshal([]byte(rest), &f); err != nil {
+			return nil, fmt.Errorf("fetch: %w", err)
+		}
+
+		r.fetches = append(r.fetches, &Fetch{Time: monotonic(r.md, time.Unix(0, f.T), f.Mono), Latency: time.Duration(f.D), Err: f.Err})
+	case "T":
+		ws, ms, hasMono := strings.Cut(rest, " ")
+
+		ns, err := strconv.ParseInt(ws, 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("timestamp: %w", err)
+		}
+
+		var mono *int64
+
+		if hasMono {
+			m, err := strconv.ParseInt(ms, 10, 64)
+			if err != nil {
+				return nil, fmt.Errorf("monotonic timestamp: %w", err)
+			}
+
+			mono = &m
+		}
+
+		r.wall = time.Unix(0, ns)
+		r.t = monotonic(r.md, r.wall, mono)
+		r.vals = nil
+		r.started = true
+	case "V":
+		if err := json.Unmarshal([]byte(rest), &r.vals); err != nil {
+			return nil, fmt.Errorf("metrics: %w", err)
+		}
+	case "F":
+		sid, quoted, _ := strings.Cut(rest, " ")
+
+		id, err := strconv.Atoi(sid)
+		if err != nil {
+			return nil, fmt.Errorf("frame id: %w", err)
+		}
+
+		text, err := strconv.Unquote(quoted)
+		if err != nil {
+			return nil, fmt.Errorf("frame text: %w", err)
+		}
+
+		r.frames[id] = text
+	case "G":
+		g, id, err := parseV2Goroutine(rest)
+		if err != nil {
+			return nil, fmt.Errorf("goroutine: %w", err)
+		}
+
+		r.gs[id] = g
+	case "X":
+		id, err := strconv.Atoi(rest)
+		if err != nil {
+			return nil, fmt.Errorf("goroutine id: %w", err)
+		}
+
+		delete(r.gs, id)
+	case "O":
+		total, pause, err := parseOverhead(rest)
+		if err != nil {
+			return nil, fmt.Errorf("overhead: %w", err)
+		}
+
+		if r.pending != nil {
+			r.pending.Overhead = total
+			r.pending.Pause = pause
+		}
+	case "R":
+		r.frames = map[int]string{}
+		r.gs = map[int]*v2Goroutine{}
+	case "-":
+		s, err := r.finishSample()
+		if err != nil {
+			return nil, err
+		}
+
+		prev := r.release()
+		r.pending = s
+
+		return prev, nil
+	default:
+		return nil, fmt.Errorf("unknown record type %q", tag)
+	}
+
+	return nil, nil
+}
+
+// monotonic returns the time of a record from its monotonic offset since the start of the log, which is immune to
+// wall clock adjustments, falling back to its wall clock time.
+func monotonic(md *Metadata, wall time.Time, mono *int64) time.Time {
+	if md == nil || mono == nil {
+		return wall
+	}
+
+	return md.Start.Add(time.Duration(*mono))
+}
+
+// parseOverhead parses the body of an "O <total nanos> <pause nanos>" record.
+func parseOverhead(rest string) (time.Duration, time.Duration, error) {
+	st, sp, _ := strings.Cut(rest, " ")
+
+	total, err := strconv.ParseInt(st, 10, 64)
+	if err != nil {
+		return 0, 0, err
+	}
+
+	pause, err := strconv.ParseInt(sp, 10, 64)
+	if err != nil {
+		return 0, 0, err
+	}
+
+	return time.Duration(total), time.Duration(pause), nil
+}
+
+// parseV2Goroutine parses the body of a "G <id> <frame ids> <quoted header>" record.
+func parseV2Goroutine(rest string) (*v2Goroutine, int, error) {
+	sid, rest, _ := strings.Cut(rest, " ")
+	fids, quoted, _ := strings.Cut(rest, " ")
+
+	id, err := strconv.Atoi(sid)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	header, err := strconv.Unquote(quoted)
+	if err != nil {
+		return nil, 0, fmt.Errorf("header: %w", err)
+	}
+
+	g := &v2Goroutine{header: header}
+
+	if fids == "-" {
+		return g, id, nil
+	}
+
+	for _, f := range strings.Split(fids, ",") {
+		fid, err := strconv.Atoi(f)
+		if err != nil {
+			return nil, 0, fmt.Errorf("frame id: %w", err)
+		}
+
+		g.frames = append(g.frames, fid)
+	}
+
+	return g, id, nil
+}
+
+// v2Stacks reconstructs runtime.Stack output from the current goroutine state.
+func v2Stacks(gs map[int]*v2Goroutine, frames map[int]string) (*bytes.Buffer, error) {
+	ids := []int{}
+	for id := range gs {
+		ids = append(ids, id)
+	}
+
+	sort.Ints(ids)
+
+	var b bytes.Buffer
+
+	for _, id := range ids {
+		g := gs[id]
+		b.WriteString(g.header)
+		b.WriteByte('\n')
+
+		for _, fid := range g.frames {
+			f, ok := frames[fid]
+			if !ok {
+				return nil, fmt.Errorf("goroutine %d: undefined frame %d", id, fid)
+			}
+
+			b.WriteString(f)
+			b.WriteByte('\n')
+		}
+
+		b.WriteByte('\n')
+	}
+
+	return &b, nil
+}
@@ -0,0 +1,350 @@
+/*
+Copyright 2020 Google LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package stackparse
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/google/slowjam/internal/logformat"
+	"github.com/google/slowjam/pkg/stacklog"
+)
+
+// goroutineText formats a goroutine as runtime.Stack does, with a call and location line for each frame.
+func goroutineText(id int, state string, frames ...string) string {
+	var b strings.Builder
+
+	fmt.Fprintf(&b, "goroutine %d [%s]:\n", id, state)
+
+	for _, f := range frames {
+		fn, loc, _ := strings.Cut(f, " ")
+		fmt.Fprintf(&b, "%s(...)\n\t%s +0x1d\n", fn, loc)
+	}
+
+	if id != 1 {
+		b.WriteString("created by main.main in goroutine 1\n\t/app/main.go:12 +0x3f\n")
+	}
+
+	return b.String() + "\n"
+}
+
+// changingStacks are samples in which goroutines are unchanged, change state, move, start reusing interned frames,
+// and exit.
+var changingStacks = []string{
+	goroutineText(1, "running", "main.main /app/main.go:10") +
+		goroutineText(2, "chan receive", "main.worker /app/worker.go:20", "main.run /app/run.go:5"),
+	goroutineText(1, "running", "main.main /app/main.go:10") +
+		goroutineText(2, "chan receive", "main.worker /app/worker.go:20", "main.run /app/run.go:5"),
+	goroutineText(1, "running", "main.main /app/main.go:11") +
+		goroutineText(2, "chan receive, 1 minutes", "main.worker /app/worker.go:20", "main.run /app/run.go:5") +
+		goroutineText(3, "chan receive", "main.worker /app/worker.go:20", "main.run /app/run.go:5"),
+	goroutineText(1, "running", "main.main /app/main.go:11") +
+		goroutineText(3, "select", "main.worker /app/worker.go:21", "main.run /app/run.go:5"),
+	goroutineText(1, "sleep", "time.Sleep /go/src/runtime/time.go:300", "main.main /app/main.go:13"),
+}
+
+// manyFrames returns samples whose frames are all distinct, so that the frame table outgrows its limit and is reset.
+func manyFrames() []string {
+	stacks := []string{}
+
+	for i := 0; i < 3; i++ {
+		frames := []string{}
+		for f := 0; f < 40000; f++ {
+			frames = append(frames, fmt.Sprintf("main.f%d_%d /app/f.go:%d", i, f, f+1))
+		}
+
+		stacks = append(stacks, goroutineText(1, "running", frames...))
+	}
+
+	return stacks
+}
+
+// script is a stacklog source which returns each of a list of stacks in turn, then the last one again.
+type script struct {
+	mu     sync.Mutex
+	stacks []string
+	next   int
+	// done is closed once every stack has been returned
+	done chan struct{}
+}
+
+func newScript(stacks []string) *script {
+	return &script{stacks: stacks, done: make(chan struct{})}
+}
+
+func (s *script) source() ([]byte, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	i := min(s.next, len(s.stacks)-1)
+	s.next++
+
+	if s.next == len(s.stacks) {
+		close(s.done)
+	}
+
+	return []byte(s.stacks[i]), nil
+}
+
+// describe summarizes the goroutines of a sample, for comparison.
+func describe(s *StackSample) string {
+	var b strings.Builder
+
+	for _, g := range s.Context.Goroutines {
+		fmt.Fprintf(&b, "%d [%s]", g.ID, g.State)
+
+		for _, c := range g.Stack.Calls {
+			fmt.Fprintf(&b, " %s@%s:%d", c.Func.Complete, c.RemoteSrcPath, c.Line)
+		}
+
+		for _, c := range g.CreatedBy.Calls {
+			fmt.Fprintf(&b, " created by %s", c.Func.Complete)
+		}
+
+		b.WriteString("\n")
+	}
+
+	return b.String()
+}
+
+// checkRoundTrip checks that a stack log read back has the given stacks, in order.
+func checkRoundTrip(t *testing.T, r *Reader, stacks []string) {
+	t.Helper()
+	defer r.Close()
+
+	l, err := readAll(r)
+	if err != nil {
+		t.Fatalf("read: %v", err)
+	}
+
+	if len(l.Samples) != len(stacks) {
+		t.Fatalf("read %d samples, want %d", len(l.Samples), len(stacks))
+	}
+
+	if l.Metadata == nil {
+		t.Error("header was not read")
+	}
+
+	for i, s := range l.Samples {
+		want, err := NewSample(s.Time, []byte(stacks[i]))
+		if err != nil {
+			t.Fatalf("NewSample: %v", err)
+		}
+
+		if got, want := describe(s), describe(want); got != want {
+			t.Errorf("sample %d:\ngot:\n%swant:\n%s", i, got, want)
+		}
+
+		if i > 0 && s.Time.Before(l.Samples[i-1].Time) {
+			t.Errorf("sample %d at %s is before the previous one", i, s.Time)
+		}
+	}
+}
+
+// record logs each of stacks as a sample to c.Path or c.Writer, then stops.
+func record(t *testing.T, c stacklog.Config, stacks []string) {
+	t.Helper()
+
+	src := newScript(stacks)
+	c.Source = src.source
+	c.Format = stacklog.FormatV2
+	c.Poll = time.Millisecond
+	c.MaxSamples = len(stacks)
+	c.Quiet = true
+
+	s, err := stacklog.Start(c)
+	if err != nil {
+		t.Fatalf("start: %v", err)
+	}
+
+	<-src.done
+
+	if err := s.Stop(); err != nil {
+		t.Fatalf("stop: %v", err)
+	}
+}
+
+func TestV2RoundTrip(t *testing.T) {
+	tests := []struct {
+		name   string
+		stacks []string
+		// records must each appear in the log
+		records []string
+	}{
+		{name: "changing", stacks: changingStacks, records: []string{"\nF ", "\nG ", "\nX 2\n", "\nL "}},
+		{name: "frame table reset", stacks: manyFrames(), records: []string{"\nR\n"}},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			var b bytes.Buffer
+
+			record(t, stacklog.Config{Writer: &b}, tc.stacks)
+
+			log := b.String()
+			for _, rec := range tc.records {
+				if !strings.Contains(log, rec) {
+					t.Errorf("log lacks a %q record", strings.TrimSpace(rec))
+				}
+			}
+
+			// Frames are interned: each is defined once until the frame table is reset
+			if !strings.Contains(log, "\nR\n") && strings.Count(log, `"main.worker(...)\n\t/app/worker.go:20 +0x1d"`) != 1 {
+				t.Errorf("a frame shared by goroutines and samples was defined more than once")
+			}
+
+			r, err := NewReader(&b)
+			if err != nil {
+				t.Fatalf("NewReader: %v", err)
+			}
+
+			checkRoundTrip(t, r, tc.stacks)
+		})
+	}
+}
+
+// TestV2RoundTripRotated checks a log rotated after every sample, each segment starting afresh with its own header,
+// which the reader reads as one log.
+func TestV2RoundTripRotated(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "out.slog")
+
+	record(t, stacklog.Config{Path: path, RotateSize: 1}, changingStacks)
+
+	segments := Segments(path)
+	if len(segments) < 2 {
+		t.Fatalf("log was not rotated: %v", segments)
+	}
+
+	for _, p := range segments {
+		bs, err := os.ReadFile(p)
+		if err != nil {
+			t.Fatalf("read segment: %v", err)
+		}
+
+		// The segment opened by rotating after the final sample is left empty
+		if len(bs) > 0 && !strings.HasPrefix(string(bs), logformat.V2Magic+"\nH ") {
+			t.Errorf("segment %s does not start with the magic line and header", p)
+		}
+	}
+
+	r, err := OpenFile(path)
+	if err != nil {
+		t.Fatalf("OpenFile: %v", err)
+	}
+
+	checkRoundTrip(t, r, changingStacks)
+}
+
+// TestV2RoundTripTriggered checks flight-recorder dumps appended to a writer, each a stream of its own.
+func TestV2RoundTripTriggered(t *testing.T) {
+	var b bytes.Buffer
+
+	src := newScript(changingStacks)
+
+	s, err := stacklog.Start(stacklog.Config{
+		Writer:      &b,
+		Source:      src.source,
+		Poll:        time.Hour,
+		RingSamples: 100,
+		Quiet:       true,
+	})
+	if err != nil {
+		t.Fatalf("start: %v", err)
+	}
+
+	for range changingStacks {
+		if err := s.Trigger(); err != nil {
+			t.Fatalf("trigger: %v", err)
+		}
+	}
+
+	if err := s.Stop(); err != nil {
+		t.Fatalf("stop: %v", err)
+	}
+
+	if n := strings.Count(b.String(), logformat.V2Magic+"\n"); n != len(changingStacks) {
+		t.Errorf("log has %d magic lines, want one per dump", n)
+	}
+
+	r, err := NewReader(&b)
+	if err != nil {
+		t.Fatalf("NewReader: %v", err)
+	}
+
+	checkRoundTrip(t, r, changingStacks)
+}
+
+// TestFetchesWithoutSample checks that attempts to fetch stacks are kept when no sample follows them in the segment.
+func TestFetchesWithoutSample(t *testing.T) {
+	const (
+		failed = `L {"t":1000000000,"d":2000000,"err":"connection refused"}` + "\n"
+		sample = "T 2000000000\nF 1 \"main.main()\\n\\t/app/main.go:10 +0x1d\"\nG 1 1 \"goroutine 1 [running]:\"\n-\n"
+	)
+
+	tests := []struct {
+		name     string
+		segments []string
+		// attached is how many attempts belong to the samples, and kept how many are left in Log.Fetches
+		samples  int
+		attached int
+		kept     int
+	}{
+		{name: "every fetch failed", segments: []string{failed + failed}, kept: 2},
+		{name: "after the last sample", segments: []string{sample + failed}, samples: 1, attached: 1},
+		{name: "before a sample in the next segment", segments: []string{failed, failed + sample}, samples: 1, attached: 2},
+		{name: "in the last segment", segments: []string{sample, failed}, samples: 1, kept: 1},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "out.slog")
+
+			for i, seg := range tc.segments {
+				if err := os.WriteFile(logformat.SegmentPath(path, i), []byte(logformat.V2Magic+"\n"+seg), 0o600); err != nil {
+					t.Fatalf("write segment: %v", err)
+				}
+			}
+
+			r, err := OpenFile(path)
+			if err != nil {
+				t.Fatalf("OpenFile: %v", err)
+			}
+			defer r.Close()
+
+			l, err := readAll(r)
+			if err != nil {
+				t.Fatalf("read: %v", err)
+			}
+
+			attached := 0
+			for _, s := range l.Samples {
+				attached += len(s.Fetches)
+			}
+
+			if len(l.Samples) != tc.samples || attached != tc.attached || len(l.Fetches) != tc.kept {
+				t.Errorf("got %d samples with %d fetches and %d kept, want %d with %d and %d kept",
+					len(l.Samples), attached, len(l.Fetches), tc.samples, tc.attached, tc.kept)
+			}
+		})
+	}
+}
@@ -19,45 +19,173 @@ package text
 
 import (
 	"fmt"
-	"sort"
 	"strings"
+	"time"
 
 	"github.com/google/slowjam/pkg/stackparse"
 )
 
-// Tree outputs a human-readable tree of goroutines found.
+// Tree outputs a human-readable tree of goroutines found. A timeline merged from several processes is output as a
+// section per process.
 func Tree(tl *stackparse.Timeline) string {
 	var sb strings.Builder
 
-	sb.WriteString(fmt.Sprintf("%d samples over %s\n", tl.Samples, tl.End.Sub(tl.Start)))
+	if len(tl.Processes) == 0 {
+		sb.WriteString(fmt.Sprintf("%d samples over %s\n", tl.Samples, tl.End.Sub(tl.Start)))
+		writeProcess(&sb, tl, tl.End.Sub(tl.Start))
 
-	gor := []int{}
+		return sb.String()
+	}
+
+	sb.WriteString(fmt.Sprintf("%d samples from %d processes over %s\n\n", tl.Samples, len(tl.Processes), tl.End.Sub(tl.Start)))
+
+	for _, p := range tl.Processes {
+		sb.WriteString(fmt.Sprintf("## %s: %d samples over %s from %s\n", p.Name, p.Timeline.Samples, p.Duration, p.Offset))
+		writeProcess(&sb, p.Timeline, p.Duration)
+	}
+
+	return sb.String()
+}
+
+// writeProcess outputs the metadata, markers and goroutines of a single process, which was sampled for wall time.
+func writeProcess(sb *strings.Builder, tl *stackparse.Timeline, wall time.Duration) {
+	for _, line := range tl.Metadata.Describe() {
+		sb.WriteString(fmt.Sprintf("%s\n", line))
+	}
+
+	total := stackparse.StateTimes{}
+	for _, g := range tl.Goroutines {
+		total.Add(g.States)
+	}
+
+	if len(total) > 0 {
+		sb.WriteString(fmt.Sprintf("goroutine time: %s\n", breakdown(total)))
+	}
+
+	if tl.Overhead > 0 {
+		sb.WriteString(fmt.Sprintf("sampler overhead: %s (%s)", tl.Overhead.Round(time.Microsecond), overheadPercent(tl.Overhead, wall)))
+
+		// Stacks fetched from another process do not pause it
+		if p := tl.WorstPause(); p > 0 {
+			sb.WriteString(fmt.Sprintf(", worst pause %s", p.Round(time.Microsecond)))
+		}
 
-	for k := range tl.Goroutines {
-		gor = append(gor, k)
+		sb.WriteString("\n")
+	}
+
+	if len(tl.Fetches) > 0 {
+		sb.WriteString(fmt.Sprintf("fetches: %d, %d failed, slowest %s\n", len(tl.Fetches), tl.FailedFetches(), tl.SlowestFetch().Round(time.Microsecond)))
+	}
+
+	if err := lastFetchError(tl); err != "" {
+		sb.WriteString(fmt.Sprintf("last failed fetch: %s\n", err))
+	}
+
+	sb.WriteString("\n")
+
+	for _, m := range tl.Markers {
+		if m.Instant() {
+			sb.WriteString(fmt.Sprintf("=== %s @ %s ===\n", m.Name, m.StartDelta))
+			continue
+		}
+
+		sb.WriteString(fmt.Sprintf("=== %s @ %s - %s (%s) ===\n", m.Name, m.StartDelta, m.EndDelta, m.EndDelta-m.StartDelta))
+	}
+
+	for _, g := range tl.Gaps {
+		sb.WriteString(fmt.Sprintf("!!! %s @ %s - %s !!!\n", g.Reason, g.StartDelta, g.EndDelta))
+	}
+
+	if len(tl.Markers) > 0 || len(tl.Gaps) > 0 {
+		sb.WriteString("\n")
 	}
 
-	sort.Ints(gor)
+	group := ""
+
+	for _, g := range stackparse.SortedGoroutines(tl) {
+		if g.Group != group {
+			group = g.Group
+			sb.WriteString(fmt.Sprintf("# %s\n\n", group))
+		}
 
-	for _, gid := range gor {
-		g := tl.Goroutines[gid]
 		funcName := ""
 		if len(g.Signature.CreatedBy.Calls) != 0 {
 			call := g.Signature.CreatedBy.Calls[0]
 			funcName = fmt.Sprintf("%s @ %s:%d", stackparse.PkgDotName(call.Func), call.RemoteSrcPath, call.Line)
 		}
-		sb.WriteString(fmt.Sprintf("goroutine %d (%s)\n", gid, funcName))
+
+		if len(g.Labels) > 0 {
+			sb.WriteString(fmt.Sprintf("goroutine %d (%s) {%s}\n", g.ID, funcName, g.Labels))
+		} else {
+			sb.WriteString(fmt.Sprintf("goroutine %d (%s)\n", g.ID, funcName))
+		}
+
+		if len(g.States) > 0 {
+			sb.WriteString(fmt.Sprintf("  %s\n", breakdown(g.States)))
+		}
 
 		for i, l := range g.Layers {
 			for _, c := range l.Calls {
 				if c.Samples > 1 {
-					sb.WriteString(fmt.Sprintf(" %s %s execution time: %s (%d samples)\n", strings.Repeat(" ", i), c.Name, c.EndDelta-c.StartDelta, c.Samples))
+					sb.WriteString(fmt.Sprintf(" %s %s execution time: %s (%d samples: %s)\n", strings.Repeat(" ", i), c.Name, c.EndDelta-c.StartDelta, c.Samples, percentages(c.States)))
 				}
 			}
 		}
 
 		sb.WriteString("\n")
 	}
+}
 
-	return sb.String()
+// lastFetchError returns why the last failed attempt to fetch stacks failed, if any did.
+func lastFetchError(tl *stackparse.Timeline) string {
+	for i := len(tl.Fetches) - 1; i >= 0; i-- {
+		if tl.Fetches[i].Err != "" {
+			return tl.Fetches[i].Err
+		}
+	}
+
+	return ""
+}
+
+// overheadPercent returns the sampler overhead as a percentage of the time sampled.
+func overheadPercent(overhead time.Duration, wall time.Duration) string {
+	if wall <= 0 {
+		return "n/a"
+	}
+
+	return fmt.Sprintf("%.2f%% of %s", float64(overhead)*100/float64(wall), wall.Round(time.Millisecond))
+}
+
+// percentages summarizes the share of time spent in each goroutine state class.
+func percentages(st stackparse.StateTimes) string {
+	cs := st.Classes()
+	total := st.Total()
+
+	parts := []string{}
+
+	for _, c := range stackparse.StateClasses {
+		if cs[c] == 0 {
+			continue
+		}
+
+		parts = append(parts, fmt.Sprintf("%d%% %s", cs[c]*100/total, c.Description()))
+	}
+
+	return strings.Join(parts, ", ")
+}
+
+// breakdown summarizes the time spent in each goroutine state class.
+func breakdown(st stackparse.StateTimes) string {
+	cs := st.Classes()
+	parts := []string{}
+
+	for _, c := range stackparse.StateClasses {
+		if cs[c] == 0 {
+			continue
+		}
+
+		parts = append(parts, fmt.Sprintf("%s %s", c.Description(), cs[c].Round(time.Millisecond)))
+	}
+
+	return strings.Join(parts, ", ")
 }
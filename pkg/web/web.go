@@ -18,10 +18,10 @@ limitations under the License.
 package web
 
 import (
+	"encoding/json"
 	"fmt"
 	"image/color"
 	"io"
-	"sort"
 	"strings"
 	"text/template"
 	"time"
@@ -34,12 +34,111 @@ import (
 var ganttTemplate = `
 <html>
   <head>
+    <title>SlowJam{{ if .TL.Metadata }}: {{ .TL.Metadata.Command | html }}{{ end }}</title>
     <script type="text/javascript" src="https://www.gstatic.com/charts/loader.js"></script>
     <script type="text/javascript">
-      google.charts.load('current', {'packages': ['timeline', 'controls']});
-      google.charts.setOnLoadCallback(drawTimeline);
+      google.charts.load('current', {'packages': ['timeline', 'controls', 'corechart']});
+      google.charts.setOnLoadCallback(function() {
+        drawMetrics();
+        drawTimeline();
+      });
+
+      // Runtime metrics by name, as [milliseconds, value] pairs
+      var metrics = {{ .TL | MetricsJSON }};
+
+      function drawMetrics() {
+        var container = document.getElementById('metrics');
+        Object.keys(metrics).sort().forEach(function(name) {
+          var div = document.createElement('div');
+          container.appendChild(div);
+
+          var data = new google.visualization.DataTable();
+          data.addColumn('number', 'ms');
+          data.addColumn('number', name);
+          data.addRows(metrics[name]);
+
+          var chart = new google.visualization.LineChart(div);
+          chart.draw(data, {
+            title: name,
+            width: 3200,
+            height: 120,
+            legend: { position: 'none' },
+            hAxis: { viewWindow: { min: 0, max: {{ .Duration | Milliseconds }} } },
+          });
+        });
+      }
+
+      // Markers and phases, which are overlaid across every row. The timeline chart has no layout interface, so they
+      // are positioned from a bar of spanColor, which spans the whole recording in each markers row.
+      var duration = {{ .Duration | Milliseconds }};
+      var spanColor = '#f0eeed';
+      var markers = [
+        {{ range $p := .TL.Procs }}
+          {{ range .Timeline.Markers }}
+            { start: {{ .StartDelta | Milliseconds }}, end: {{ . | MarkerEnd }} },
+          {{ end }}
+        {{ end }}
+      ];
+
+      function drawMarkers() {
+        var container = document.getElementById('timeline');
+        var overlay = document.getElementById('markers');
+        overlay.innerHTML = '';
+
+        // The markers rows may have been filtered out
+        var span = container.querySelector('rect[fill="' + spanColor + '"]');
+        if (!span || duration == 0) {
+          return;
+        }
+
+        var box = container.getBoundingClientRect();
+        var axis = span.getBoundingClientRect();
+        var scale = axis.width / duration;
+
+        markers.forEach(function(m) {
+          var band = document.createElement('div');
+          band.style.cssText = 'position: absolute; top: 0; bottom: 0; background: rgba(153, 153, 153, 0.25); border-left: 1px solid #999999';
+          band.style.left = (axis.left - box.left + m.start * scale) + 'px';
+          band.style.width = Math.max(1, (m.end - m.start) * scale) + 'px';
+          overlay.appendChild(band);
+        });
+      }
 
-      function dataTable() {
+      // Times the sampler stopped the world, or fetched stacks from another process, shown on request
+      var sampler = [
+        {{ range $p := .TL.Procs }}
+          {{ range .Timeline.Pauses }}
+            [ '{{ ProcLane $p "sampler" | js }}', 'pause', '#000000', '#000000', new Date({{ .StartDelta | Milliseconds }}), new Date({{ . | PauseEnd }}) ],
+          {{ end }}
+          {{ range .Timeline.Fetches }}
+            [ '{{ ProcLane $p "fetches" | js }}', '{{ . | FetchName | js }}', '{{ . | FetchColor }}', '{{ . | FetchColor }}', new Date({{ .StartDelta | Milliseconds }}), new Date({{ . | FetchEnd }}) ],
+          {{ end }}
+        {{ end }}
+      ];
+
+      // Each row has both a package color and a goroutine state color
+      var rows = [
+        {{ range $p := .TL.Procs }}
+          {{ range .Timeline.Gaps }}
+            [ '{{ ProcLane $p "clock" | js }}', '{{ .Reason | js }}', '#d62728', '#d62728', new Date({{ .StartDelta | Milliseconds }}), new Date({{ . | GapEnd }}) ],
+          {{ end }}
+          {{ if .Timeline.Markers }}
+            [ '{{ ProcLane $p "markers" | js }}', '', spanColor, spanColor, new Date(0), new Date(duration) ],
+          {{ end }}
+          {{ range .Timeline.Markers }}
+            [ '{{ ProcLane $p "markers" | js }}', '{{ .Name | js }}', '#999999', '#999999', new Date({{ .StartDelta | Milliseconds }}), new Date({{ . | MarkerEnd }}) ],
+          {{ end }}
+          {{ range $g := .Timeline | Sorted }}
+            {{ range $index, $layer := .Layers}}
+              {{ range $layer.Calls }}
+                [ '{{ Lane $p $g | js }}', '{{ .Name }}', '{{ Color .Package $index }}', '{{ .States | StateColor }}', new Date({{ .StartDelta | Milliseconds }}), new Date({{ .EndDelta | Milliseconds }}) ],
+              {{ end }}
+            {{ end }}
+          {{ end }}
+        {{ end }}
+      ];
+
+      function dataTable(colorBy) {
         var dataTable = new google.visualization.DataTable();
 
         dataTable.addColumn({ type: 'string', id: 'Layer' });
@@ -48,15 +147,10 @@ var ganttTemplate = `
         dataTable.addColumn({ type: 'date', id: 'Start' });
         dataTable.addColumn({ type: 'date', id: 'End' });
 
-        dataTable.addRows([
-          {{ range $g := .TL.Goroutines | Sorted }}
-            {{ range $index, $layer := .Layers}}
-              {{ range $layer.Calls }}
-                [ '{{ $g.ID }}: {{ $g.Signature | Creator }}', '{{ .Name }}', '{{ Color .Package $index }}', new Date({{ .StartDelta | Milliseconds }}), new Date({{ .EndDelta | Milliseconds }}) ],
-              {{ end }}
-            {{ end }}
-          {{ end }}
-        ]);
+        var shown = document.getElementById('sampler').checked ? sampler.concat(rows) : rows;
+        dataTable.addRows(shown.map(function(r) {
+          return [ r[0], r[1], colorBy == 'state' ? r[3] : r[2], r[4], r[5] ];
+        }));
         return dataTable;
       }
 
@@ -82,19 +176,51 @@ var ganttTemplate = `
           containerId: 'timeline',
         });
 
+        google.visualization.events.addListener(timeline, 'ready', drawMarkers);
         dashboard.bind(picker, timeline);
         var options = {
           avoidOverlappingGridLines: false,
         };
-        dashboard.draw(dataTable(), options);
+        dashboard.draw(dataTable(document.getElementById('colorby').value), options);
       }
     </script>
   </head>
   <body>
-    <h1>SlowJam for {{ .Duration}} ({{ .TL.Samples }} samples, {{ len .TL.Goroutines }} goroutines) - <a href="/">full</a> | <a href="/simple">simple</a></h1>
+    <h1>SlowJam for {{ .Duration}} ({{ .TL.Samples }} samples, {{ .TL | GoroutineCount }} goroutines) - <a href="/">full</a> | <a href="/simple">simple</a></h1>
+    {{ range .TL.Procs }}
+      {{ if .Name }}
+        <h2>{{ .Name | html }} from {{ .Offset }}</h2>
+      {{ end }}
+      {{ range .Timeline.Metadata.Describe }}
+        <div class="metadata">{{ . | html }}</div>
+      {{ end }}
+    {{ end }}
+    <div>
+      Color by: <select id="colorby" onchange="drawTimeline()">
+        <option value="package">package</option>
+        <option value="state">goroutine state</option>
+      </select>
+      {{ range StateClasses }}
+        <span style="color: {{ . | ClassColor }}">&#9632; {{ .Description }}</span>
+      {{ end }}
+      {{ if .TL.WorstPause }}
+        <label><input type="checkbox" id="sampler" onchange="drawTimeline()"> show sampler pauses</label>
+      {{ else if .TL.Fetches }}
+        <label><input type="checkbox" id="sampler" onchange="drawTimeline()"> show stack fetches</label>
+      {{ else }}
+        <input type="checkbox" id="sampler" style="display: none">
+      {{ end }}
+    </div>
+    {{ if .TL.Overhead }}
+      <div class="metadata">{{ .TL | Overhead }}</div>
+    {{ end }}
+    <div id="metrics"></div>
     <div id="dashboard">
       <div id="picker"></div>
-      <div id="timeline" style="width: 3200px; height: 1024px;"></div>
+      <div style="position: relative">
+        <div id="timeline" style="width: 3200px; height: 1024px;"></div>
+        <div id="markers" style="position: absolute; top: 0; left: 0; width: 100%; height: 100%; pointer-events: none"></div>
+      </div>
     </div>
   </body>
 </html>
@@ -105,11 +231,25 @@ func Render(w io.Writer, tl *stackparse.Timeline) error {
 	updateColorMap(tl, colorMap)
 
 	fmap := template.FuncMap{
-		"Milliseconds": milliseconds,
-		"Creator":      creator,
-		"Height":       height,
-		"Color":        callColor,
-		"Sorted":       sorted,
+		"Milliseconds":   milliseconds,
+		"Creator":        creator,
+		"Height":         height,
+		"Color":          callColor,
+		"Sorted":         stackparse.SortedGoroutines,
+		"Lane":           lane,
+		"ProcLane":       procLane,
+		"GoroutineCount": goroutineCount,
+		"MarkerEnd":      markerEnd,
+		"StateColor":     stateColor,
+		"ClassColor":     classColor,
+		"StateClasses":   func() []stackparse.StateClass { return stackparse.StateClasses },
+		"MetricsJSON":    metricsJSON,
+		"PauseEnd":       pauseEnd,
+		"FetchEnd":       fetchEnd,
+		"FetchName":      fetchName,
+		"FetchColor":     fetchColor,
+		"GapEnd":         gapEnd,
+		"Overhead":       overhead,
 	}
 
 	t, err := template.New("timeline").Funcs(fmap).Parse(ganttTemplate)
@@ -133,23 +273,127 @@ func Render(w io.Writer, tl *stackparse.Timeline) error {
 	return nil
 }
 
+// metricsJSON encodes metric time series as a JSON object of [milliseconds, value] pairs. Metrics of merged
+// processes are prefixed by the process name.
+func metricsJSON(tl *stackparse.Timeline) (string, error) {
+	series := map[string][][2]float64{}
+
+	for _, proc := range tl.Procs() {
+		for name, points := range proc.Timeline.Metrics {
+			name = procLane(proc, name)
+
+			for _, p := range points {
+				series[name] = append(series[name], [2]float64{float64(p.Delta.Milliseconds()), p.Value})
+			}
+		}
+	}
+
+	bs, err := json.Marshal(series)
+
+	return string(bs), err
+}
+
 func milliseconds(d time.Duration) string {
 	return fmt.Sprintf("%d", d.Milliseconds())
 }
 
-func sorted(grs map[int]*stackparse.GoroutineTimeline) []*stackparse.GoroutineTimeline {
-	rt := []*stackparse.GoroutineTimeline{}
-	ids := []int{}
-	for id := range grs {
-		ids = append(ids, id)
+// markerEnd returns the end of a marker in milliseconds, widening instants so that they remain visible.
+func markerEnd(m *stackparse.Marker) string {
+	if m.Instant() {
+		return fmt.Sprintf("%d", m.StartDelta.Milliseconds()+1)
 	}
-	sort.Ints(ids)
-	for _, id := range ids {
-		if gr := grs[id]; gr != nil {
-			rt = append(rt, gr)
-		}
+
+	return milliseconds(m.EndDelta)
+}
+
+// overhead summarizes the time spent by the sampler.
+func overhead(tl *stackparse.Timeline) string {
+	s := fmt.Sprintf("sampler overhead: %s", tl.Overhead.Round(time.Microsecond))
+
+	if wall := tl.End.Sub(tl.Start); wall > 0 {
+		s += fmt.Sprintf(" (%.2f%% of wall time)", float64(tl.Overhead)*100/float64(wall))
+	}
+
+	if p := tl.WorstPause(); p > 0 {
+		s += fmt.Sprintf(", worst pause %s", p.Round(time.Microsecond))
+	}
+
+	if f := tl.SlowestFetch(); f > 0 {
+		s += fmt.Sprintf(", slowest fetch %s, %d failed", f.Round(time.Microsecond), tl.FailedFetches())
 	}
-	return rt
+
+	return s
+}
+
+// visibleEnd returns the end of a span in milliseconds, widening it to at least a millisecond so that it remains
+// visible.
+func visibleEnd(start time.Duration, end time.Duration) string {
+	return fmt.Sprintf("%d", max(end.Milliseconds(), start.Milliseconds()+1))
+}
+
+// pauseEnd returns the end of a sampler pause in milliseconds.
+func pauseEnd(p *stackparse.Pause) string {
+	return visibleEnd(p.StartDelta, p.EndDelta)
+}
+
+// fetchEnd returns the end of an attempt to fetch stacks in milliseconds.
+func fetchEnd(f *stackparse.FetchSpan) string {
+	return visibleEnd(f.StartDelta, f.EndDelta)
+}
+
+// fetchName describes an attempt to fetch stacks.
+func fetchName(f *stackparse.FetchSpan) string {
+	if f.Err != "" {
+		return fmt.Sprintf("failed: %s", f.Err)
+	}
+
+	return "fetch"
+}
+
+// fetchColor colors failed attempts to fetch stacks red.
+func fetchColor(f *stackparse.FetchSpan) string {
+	if f.Err != "" {
+		return "#d62728"
+	}
+
+	return "#1f77b4"
+}
+
+// gapEnd returns the end of a gap in milliseconds, widening instant clock jumps so that they remain visible.
+func gapEnd(g *stackparse.Gap) string {
+	if g.EndDelta == g.StartDelta {
+		return fmt.Sprintf("%d", g.StartDelta.Milliseconds()+1)
+	}
+
+	return milliseconds(g.EndDelta)
+}
+
+// lane returns the row label for a goroutine, prefixed by its process and group if it has them.
+func lane(p *stackparse.Process, g *stackparse.GoroutineTimeline) string {
+	if g.Group != "" {
+		return procLane(p, fmt.Sprintf("%s / %d: %s", g.Group, g.ID, creator(&g.Signature)))
+	}
+
+	return procLane(p, fmt.Sprintf("%d: %s", g.ID, creator(&g.Signature)))
+}
+
+// procLane prefixes a row label with the name of its process, so that the rows of each process are grouped.
+func procLane(p *stackparse.Process, label string) string {
+	if p.Name == "" {
+		return label
+	}
+
+	return fmt.Sprintf("%s / %s", p.Name, label)
+}
+
+// goroutineCount returns the number of goroutines in a timeline, across every process.
+func goroutineCount(tl *stackparse.Timeline) int {
+	n := 0
+	for _, p := range tl.Procs() {
+		n += len(p.Timeline.Goroutines)
+	}
+
+	return n
 }
 
 func creator(s *stack.Signature) string {
@@ -166,6 +410,13 @@ func height(ls []*stackparse.Layer) string {
 func updateColorMap(tl *stackparse.Timeline, cm map[string]color.RGBA) {
 	chosen := map[string]bool{}
 
+	for _, p := range tl.Procs() {
+		updateProcessColors(p.Timeline, cm, chosen)
+	}
+}
+
+// updateProcessColors chooses colors for the packages seen in a single process.
+func updateProcessColors(tl *stackparse.Timeline, cm map[string]color.RGBA, chosen map[string]bool) {
 	for _, g := range tl.Goroutines {
 		for _, l := range g.Layers {
 			for _, c := range l.Calls {
@@ -219,3 +470,23 @@ func callColor(pkg string, level int) string {
 	c := colorMap[pkg]
 	return fmt.Sprintf("#%02x%02x%02x", c.R, c.G, c.B)
 }
+
+// stateClassColors are the colors used for goroutine state classes.
+var stateClassColors = map[stackparse.StateClass]string{
+	stackparse.StateRunning: "#2ca02c",
+	stackparse.StateSyscall: "#9467bd",
+	stackparse.StateIO:      "#1f77b4",
+	stackparse.StateLock:    "#d62728",
+	stackparse.StateChannel: "#ff7f0e",
+	stackparse.StateSleep:   "#7f7f7f",
+	stackparse.StateOther:   "#bcbd22",
+}
+
+func classColor(c stackparse.StateClass) string {
+	return stateClassColors[c]
+}
+
+// stateColor returns the color of the state a call spent the most time in.
+func stateColor(st stackparse.StateTimes) string {
+	return classColor(st.Dominant())
+}